@@ -0,0 +1,115 @@
+package main
+
+import "archive/zip"
+import "encoding/json"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "net/http"
+import "os"
+import "path/filepath"
+
+// GET /export/zip, a zip of everything in -store-dir under store/, and each request kept by
+// -history as requests/<seq>-<time>.json.  The archive is written as it's built, so
+// nothing is held in memory beyond one file's copy buffer.
+func exportZip(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		respondError(writer, http.StatusMethodNotAllowed, "only GET is supported")
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/zip")
+	writer.Header().Set("Content-Disposition", "attachment; filename=\"datastore.zip\"")
+
+	archive := zip.NewWriter(writer)
+
+	err := zipStore(archive)
+	if err == nil {
+		err = zipHistory(archive)
+	}
+
+	if err == nil {
+		err = archive.Close()
+	}
+
+	// The headers have gone out by now, so all that's left is to cut the archive short.
+	if err != nil {
+		fmt.Fprintf(ERRORS, "Error writing zip export: %s\n", err)
+	}
+}
+
+func zipStore(archive *zip.Writer) error {
+	if STOREDIR == "" {
+		return nil
+	}
+
+	files, err := ioutil.ReadDir(STOREDIR)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range files {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+
+		err := zipFile(archive, filepath.Join(STOREDIR, info.Name()), info)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func zipFile(archive *zip.Writer, path string, info os.FileInfo) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+
+	header.Name = "store/" + info.Name()
+	header.Method = zip.Deflate
+
+	entry, err := archive.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(entry, file)
+
+	return err
+}
+
+func zipHistory(archive *zip.Writer) error {
+	for _, entry := range rememberedRequests() {
+		data, err := json.MarshalIndent(entry, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		name := fmt.Sprintf("requests/%06d-%s.json", entry.Seq, entry.Time.UTC().Format("20060102T150405.000"))
+
+		file, err := archive.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   zip.Deflate,
+			Modified: entry.Time,
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = file.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
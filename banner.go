@@ -0,0 +1,84 @@
+package main
+
+import "flag"
+import "fmt"
+import "io"
+import "sort"
+import "strings"
+
+var QUIET bool
+
+// Print a summary of the features in effect at startup, with secrets redacted.
+func printBanner(output io.Writer) {
+	tls := "off"
+	if TLSCERT != "" {
+		tls = "on, " + TLSMINVERSION + " minimum"
+		if CLIENTCA != "" {
+			tls += ", client certificates verified against " + CLIENTCA
+		}
+	}
+	fmt.Fprintf(output, "# tls: %s\n", tls)
+
+	var auth []string
+	if HMACSECRET != "" {
+		auth = append(auth, "hmac signatures in "+HMACHEADER)
+	}
+	if JWTKEY != "" {
+		auth = append(auth, "jwt verification")
+	}
+	if ADMINTOKEN != "" {
+		auth = append(auth, "admin token for /admin/faults")
+	}
+	fmt.Fprintf(output, "# auth: %s\n", joinOr(auth, "off"))
+
+	store := "off"
+	if STOREDIR != "" {
+		store = "raw files in " + STOREDIR
+		if STOREDECODED {
+			store = "decoded files in " + STOREDIR
+		}
+		if STOREREQUIRED {
+			store += ", required"
+		}
+	}
+	fmt.Fprintf(output, "# store: %s, last %d requests kept for /assert\n", store, HISTORY)
+
+	settings, _ := currentFaults()
+	faults := "off"
+	if settings.FailRate > 0 || settings.Delay != "" && settings.Delay != "0s" {
+		faults = fmt.Sprintf("fail_rate=%g status=%d delay=%s", settings.FailRate, settings.Status, settings.Delay)
+		if FAILAFTERREQUESTS > 0 {
+			faults += fmt.Sprintf(" after %d requests", FAILAFTERREQUESTS)
+		}
+		if FAILAFTERDURATION > 0 {
+			faults += fmt.Sprintf(" after %s", FAILAFTERDURATION)
+		}
+	}
+	fmt.Fprintf(output, "# faults: %s\n", faults)
+
+	if FORWARD != "" {
+		fmt.Fprintf(output, "# forwarding to %s\n", FORWARD)
+	}
+
+	fmt.Fprintf(output, "# showing at most %d bytes per value\n", MAXBYTES)
+
+	var options []string
+	flag.Visit(func(option *flag.Flag) {
+		value := option.Value.String()
+		if SECRETOPTIONS[option.Name] && value != "" {
+			value = "[redacted]"
+		}
+
+		options = append(options, fmt.Sprintf("-%s=%s", option.Name, value))
+	})
+	sort.Strings(options)
+	fmt.Fprintf(output, "# options: %s\n", joinOr(options, "defaults"))
+}
+
+func joinOr(values []string, empty string) string {
+	if len(values) == 0 {
+		return empty
+	}
+
+	return strings.Join(values, ", ")
+}
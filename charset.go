@@ -0,0 +1,104 @@
+package main
+
+import "encoding/binary"
+import "fmt"
+import "io"
+import "mime"
+import "net/http"
+import "strings"
+import "unicode/utf16"
+import "unicode/utf8"
+
+// How raw bodies are transcoded for display: utf-8, latin1 or auto.
+var BODYENCODING string
+
+// Convert text in the named charset to UTF-8.  Returns false for charsets it doesn't know.
+func toUTF8(data []byte, charset string) ([]byte, bool) {
+	switch strings.ToLower(charset) {
+	case "utf-8", "utf8", "us-ascii", "ascii":
+		return data, true
+
+	case "iso-8859-1", "latin1", "latin-1", "l1":
+		converted := make([]byte, 0, len(data))
+		for _, char := range data {
+			converted = utf8.AppendRune(converted, rune(char))
+		}
+
+		return converted, true
+
+	case "utf-16":
+		if len(data) >= 2 && data[0] == 0xff && data[1] == 0xfe {
+			return decodeUTF16(data[2:], binary.LittleEndian), true
+		}
+
+		if len(data) >= 2 && data[0] == 0xfe && data[1] == 0xff {
+			data = data[2:]
+		}
+
+		return decodeUTF16(data, binary.BigEndian), true
+
+	case "utf-16le":
+		return decodeUTF16(data, binary.LittleEndian), true
+
+	case "utf-16be":
+		return decodeUTF16(data, binary.BigEndian), true
+	}
+
+	return data, false
+}
+
+func decodeUTF16(data []byte, order binary.ByteOrder) []byte {
+	units := make([]uint16, len(data)/2)
+	for index := range units {
+		units[index] = order.Uint16(data[index*2:])
+	}
+
+	return []byte(string(utf16.Decode(units)))
+}
+
+// Transcode a part to UTF-8 for display according to the charset its Content-Type declares.
+func transcodePart(output io.Writer, contentType string, data []byte) []byte {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil || params["charset"] == "" {
+		return data
+	}
+
+	charset := params["charset"]
+
+	converted, ok := toUTF8(data, charset)
+	if !ok {
+		fmt.Fprintf(output, "# WARNING: unsupported charset %s, shown as is\n", charset)
+		return data
+	}
+
+	if !strings.EqualFold(charset, "utf-8") && !strings.EqualFold(charset, "utf8") {
+		fmt.Fprintf(output, "# transcoded from %s\n", charset)
+	}
+
+	return converted
+}
+
+// Transcode a raw body to UTF-8 for display according to -body-encoding.  auto uses the
+// charset the request's Content-Type declares, otherwise treats anything that isn't valid
+// UTF-8 as latin1.
+func transcodeBody(entry *RequestEntry, body []byte) []byte {
+	switch BODYENCODING {
+	case "latin1":
+		converted, _ := toUTF8(body, "latin1")
+		return converted
+
+	case "auto":
+		_, params, _ := mime.ParseMediaType(http.Header(entry.Header).Get("Content-Type"))
+		if params["charset"] != "" {
+			return transcodePart(&entry.output, http.Header(entry.Header).Get("Content-Type"), body)
+		}
+
+		if !utf8.Valid(body) {
+			fmt.Fprintf(&entry.output, "# transcoded from latin1\n")
+			converted, _ := toUTF8(body, "latin1")
+			return converted
+		}
+	}
+
+	return body
+}
@@ -0,0 +1,25 @@
+package main
+
+import "net/http"
+import "testing"
+
+func TestLatin1Body(t *testing.T) {
+	// "café" in latin1.
+	body := []byte{'c', 'a', 'f', 0xe9}
+
+	for _, encoding := range []string{"latin1", "auto"} {
+		setFlag(t, "body-encoding", encoding)
+
+		entry := newRequestEntry()
+		entry.Header = http.Header{"Content-Type": {"text/plain"}}
+
+		if shown := string(transcodeBody(entry, body)); shown != "café" {
+			t.Errorf("-body-encoding %s shows %q, want %q", encoding, shown, "café")
+		}
+	}
+
+	setFlag(t, "body-encoding", "utf-8")
+	if shown := transcodeBody(newRequestEntry(), body); string(shown) != string(body) {
+		t.Errorf("-body-encoding utf-8 changed the body to %q", shown)
+	}
+}
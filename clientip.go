@@ -0,0 +1,104 @@
+package main
+
+import "fmt"
+import "net"
+import "net/http"
+import "strings"
+
+var TRUSTPROXY bool
+var TRUSTEDPROXIES cidrList
+var ALLOWIPS cidrList
+
+// Proxies trusted by -trust-proxy when -trusted-proxies isn't given.
+const DEFAULTPROXIES = "127.0.0.0/8,::1/128"
+
+// A comma separated, repeatable list of CIDRs.
+type cidrList []*net.IPNet
+
+func (list *cidrList) String() string {
+	var cidrs []string
+	for _, network := range *list {
+		cidrs = append(cidrs, network.String())
+	}
+
+	return strings.Join(cidrs, ",")
+}
+
+func (list *cidrList) Set(value string) error {
+	for _, cidr := range strings.Split(value, ",") {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return err
+		}
+
+		*list = append(*list, network)
+	}
+
+	return nil
+}
+
+func (list cidrList) contains(ip net.IP) bool {
+	for _, network := range list {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the address of the client that sent the request.  Under -trust-proxy, when the
+// immediate peer is a trusted proxy, this is the rightmost untrusted X-Forwarded-For
+// address, or X-Real-IP.
+func clientIP(request *http.Request) string {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+
+	if !TRUSTPROXY {
+		return host
+	}
+
+	peer := net.ParseIP(host)
+	if peer == nil || !TRUSTEDPROXIES.contains(peer) {
+		return host
+	}
+
+	forwarded := strings.Split(strings.Join(request.Header.Values("X-Forwarded-For"), ","), ",")
+	for index := len(forwarded) - 1; index >= 0; index-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[index]))
+		if ip == nil {
+			break
+		}
+
+		if !TRUSTEDPROXIES.contains(ip) {
+			return ip.String()
+		}
+	}
+
+	realIP := net.ParseIP(strings.TrimSpace(request.Header.Get("X-Real-IP")))
+	if realIP != nil {
+		return realIP.String()
+	}
+
+	return host
+}
+
+// Answer requests from clients outside -allow-ip with a 403, going by clientIP.
+func allowClients(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		client := clientIP(request)
+
+		ip := net.ParseIP(client)
+		if ip == nil || !ALLOWIPS.contains(ip) {
+			fmt.Fprintf(OUTPUT, "# blocked %s request to %s from %s, not in -allow-ip\n\n",
+				request.Method, request.URL.Path, client)
+
+			respondError(writer, http.StatusForbidden, "client not allowed")
+			return
+		}
+
+		handler.ServeHTTP(writer, request)
+	})
+}
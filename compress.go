@@ -0,0 +1,134 @@
+package main
+
+import "compress/gzip"
+import "net/http"
+import "strings"
+
+// Gzip response bodies for clients that send Accept-Encoding: gzip.
+var GZIPRESPONSES bool
+
+// Whether the request accepts a gzipped response.  A q=0 gzip is a refusal.
+func acceptsGzip(request *http.Request) bool {
+	for _, coding := range strings.Split(request.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(coding), ";")
+		if strings.TrimSpace(name) != "gzip" {
+			continue
+		}
+
+		return strings.ReplaceAll(strings.TrimSpace(params), " ", "") != "q=0"
+	}
+
+	return false
+}
+
+// Compresses the response body, once there is one.  The header waits for the first
+// non-empty write, so responses without a body, such as redirects or a 204, go out
+// untouched, as do bodies that already have a Content-Encoding, such as a relayed
+// upstream response.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gzip   *gzip.Writer
+	status int
+
+	// Set once the header has gone to the wrapped writer, compressed or not.
+	wroteHeader bool
+}
+
+func (writer *gzipResponseWriter) WriteHeader(status int) {
+	// Informational responses go out straight away, ahead of the real one.
+	if status < 200 {
+		writer.ResponseWriter.WriteHeader(status)
+		return
+	}
+
+	if writer.status == 0 {
+		writer.status = status
+	}
+}
+
+// Send the header, setting up compression when compress is true and the response can
+// have a body that isn't encoded already.
+func (writer *gzipResponseWriter) start(compress bool) {
+	writer.wroteHeader = true
+	if writer.status == 0 {
+		writer.status = http.StatusOK
+	}
+
+	if compress && writer.status != http.StatusNoContent && writer.status != http.StatusNotModified &&
+		writer.Header().Get("Content-Encoding") == "" {
+		// The length set for the uncompressed body no longer applies.
+		writer.Header().Del("Content-Length")
+		writer.Header().Set("Content-Encoding", "gzip")
+		writer.Header().Add("Vary", "Accept-Encoding")
+
+		writer.gzip = gzip.NewWriter(writer.ResponseWriter)
+	}
+
+	writer.ResponseWriter.WriteHeader(writer.status)
+}
+
+func (writer *gzipResponseWriter) Write(data []byte) (int, error) {
+	if !writer.wroteHeader {
+		if len(data) == 0 {
+			return 0, nil
+		}
+
+		writer.start(true)
+	}
+
+	if writer.gzip == nil {
+		return writer.ResponseWriter.Write(data)
+	}
+
+	return writer.gzip.Write(data)
+}
+
+func (writer *gzipResponseWriter) Flush() {
+	writer.FlushError()
+}
+
+// Nothing is sent before the first write, since that decides whether to compress.
+func (writer *gzipResponseWriter) FlushError() error {
+	if !writer.wroteHeader {
+		return nil
+	}
+
+	if writer.gzip != nil {
+		err := writer.gzip.Flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	return http.NewResponseController(writer.ResponseWriter).Flush()
+}
+
+// Finish the response: send the header of a response without a body, or end the
+// compressed stream.
+func (writer *gzipResponseWriter) Close() {
+	if !writer.wroteHeader && writer.status != 0 {
+		writer.start(false)
+	}
+
+	if writer.gzip != nil {
+		writer.gzip.Close()
+	}
+}
+
+func (writer *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
+
+// Answer ?echo=true with the decompressed dataFile contents, as they were received, so
+// they're compressed once at most, under -gzip-responses.  Returns false if there was no
+// dataFile to echo.
+func writeEcho(writer http.ResponseWriter, entry *RequestEntry) bool {
+	if entry.echo == nil {
+		return false
+	}
+
+	writer.Header().Set("Content-Type", http.DetectContentType(entry.echo))
+	writer.Write(entry.echo)
+
+	return true
+}
@@ -0,0 +1,46 @@
+package main
+
+import "context"
+import "sync/atomic"
+import "time"
+
+// At most MAXCONCURRENT requests are handled at once; the rest wait up to QUEUETIMEOUT,
+// forever when it's 0, for a slot to free.
+var MAXCONCURRENT int
+var QUEUETIMEOUT time.Duration
+
+// A buffered channel holding a value per request being handled, nil without a limit.
+var slots chan struct{}
+
+// Requests being handled and waiting for a slot, updated atomically.
+var inFlight int64
+var queued int64
+
+// Wait for a slot, returning false if the client went away or -queue-timeout passed.
+func acquireSlot(ctx context.Context) bool {
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	atomic.AddInt64(&queued, 1)
+	defer atomic.AddInt64(&queued, -1)
+
+	if QUEUETIMEOUT > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, QUEUETIMEOUT)
+		defer cancel()
+	}
+
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func releaseSlot() {
+	<-slots
+}
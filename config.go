@@ -0,0 +1,300 @@
+package main
+
+import "bufio"
+import "bytes"
+import "encoding/json"
+import "flag"
+import "fmt"
+import "io/ioutil"
+import "net/http"
+import "path/filepath"
+import "regexp"
+import "sort"
+import "strconv"
+import "strings"
+
+var CONFIG string
+var EXPOSECONFIG bool
+
+// Options whose values are never shown.
+var SECRETOPTIONS = map[string]bool{
+	"admin-token": true,
+	"hmac-secret": true,
+	"jwt-key":     true,
+}
+
+// The user:password@ part of any URL in an option, such as -forward's upstream.
+var urlUserinfo = regexp.MustCompile(`([A-Za-z][A-Za-z0-9+.-]*://)[^/?#@\s]+@`)
+
+// Apply the options in a -config file by setting the flags they name, so the file fills in
+// the same option variables the command line does.  A flag given on the command line wins
+// over the file, which wins over the flag's default.  Repeatable flags such as 'addr' take
+// a list.
+//
+// Files ending in .yaml or .yml are read by parseYAML.  Anything else is a json object.
+func loadConfig(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var values map[string][]string
+
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		values, err = parseYAML(data)
+	default:
+		values, err = parseJSON(data)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+
+	given := make(map[string]bool)
+	flag.Visit(func(option *flag.Flag) {
+		given[option.Name] = true
+	})
+
+	var unknown []string
+	for name := range values {
+		if flag.Lookup(name) == nil || name == "config" {
+			unknown = append(unknown, name)
+		}
+	}
+
+	if len(unknown) != 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("%s: unknown options: %s", path, strings.Join(unknown, ", "))
+	}
+
+	for name, list := range values {
+		if given[name] {
+			continue
+		}
+
+		for _, value := range list {
+			err := flag.Set(name, value)
+			if err != nil {
+				return fmt.Errorf("%s: %s: %s", path, name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func parseJSON(data []byte) (map[string][]string, error) {
+	var object map[string]interface{}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	err := decoder.Decode(&object)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string][]string)
+	for name, value := range object {
+		list, isList := value.([]interface{})
+		if !isList {
+			list = []interface{}{value}
+		}
+
+		for _, element := range list {
+			switch element.(type) {
+			case map[string]interface{}, []interface{}, nil:
+				return nil, fmt.Errorf("%s: unsupported value %v", name, element)
+			}
+
+			values[name] = append(values[name], fmt.Sprint(element))
+		}
+	}
+
+	return values, nil
+}
+
+// Parse the subset of YAML -config accepts: top level 'key: value' lines and lists of
+// indented '- value' lines under a 'key:', with # comments.  Values are plain scalars or
+// single or double quoted strings.  Anything else YAML allows, like nested maps, flow
+// collections, anchors, aliases, tags, block scalars and multiple documents, is an error
+// naming its line rather than something silently read wrong.
+func parseYAML(data []byte) (map[string][]string, error) {
+	values := make(map[string][]string)
+
+	var current string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimRight(scanner.Text(), " \r")
+		trimmed := strings.TrimLeft(line, " ")
+
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: tabs can't indent yaml", number)
+		}
+
+		if line != trimmed {
+			if current == "" || !(trimmed == "-" || strings.HasPrefix(trimmed, "- ")) {
+				return nil, fmt.Errorf("line %d: only '- value' list items can be indented, under a 'key:' with no value", number)
+			}
+
+			value, err := yamlScalar(trimmed[1:])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", number, err)
+			}
+
+			values[current] = append(values[current], value)
+			continue
+		}
+
+		if trimmed == "---" || trimmed == "..." || strings.HasPrefix(trimmed, "%") {
+			return nil, fmt.Errorf("line %d: yaml directives and document markers aren't supported", number)
+		}
+
+		name, rest, found := strings.Cut(trimmed, ":")
+		if !found || !validOptionName(name) || (rest != "" && rest[0] != ' ') {
+			return nil, fmt.Errorf("line %d: expected 'key: value' with an option name as the key", number)
+		}
+
+		if _, seen := values[name]; seen {
+			return nil, fmt.Errorf("line %d: %s is set twice", number, name)
+		}
+
+		value, err := yamlScalar(rest)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", number, err)
+		}
+
+		current = ""
+		if value == "" && !quoted(rest) {
+			// The list items follow.
+			current = name
+			values[name] = nil
+		} else {
+			values[name] = []string{value}
+		}
+	}
+
+	return values, scanner.Err()
+}
+
+func validOptionName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, char := range name {
+		if !('a' <= char && char <= 'z' || '0' <= char && char <= '9' || char == '-' || char == '_') {
+			return false
+		}
+	}
+
+	return true
+}
+
+func quoted(text string) bool {
+	text = strings.TrimSpace(text)
+	return strings.HasPrefix(text, "\"") || strings.HasPrefix(text, "'")
+}
+
+// A plain or quoted scalar, with any trailing comment removed.
+func yamlScalar(text string) (string, error) {
+	text = strings.TrimSpace(text)
+	if text == "" || strings.HasPrefix(text, "#") {
+		return "", nil
+	}
+
+	switch text[0] {
+	case '"', '\'':
+		end := closingQuote(text)
+		if end < 0 {
+			return "", fmt.Errorf("unterminated quoted string")
+		}
+
+		rest := strings.TrimSpace(text[end+1:])
+		if rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", fmt.Errorf("unexpected %q after a quoted string", rest)
+		}
+
+		if text[0] == '\'' {
+			return strings.ReplaceAll(text[1:end], "''", "'"), nil
+		}
+
+		value, err := strconv.Unquote(text[:end+1])
+		if err != nil {
+			return "", fmt.Errorf("unsupported escape in %s", text[:end+1])
+		}
+
+		return value, nil
+
+	case '[', '{', '&', '*', '!', '|', '>', '@', '`', '%':
+		return "", fmt.Errorf("yaml %q values aren't supported, quote the value if it's a string", text[0])
+	}
+
+	if comment := strings.Index(text, " #"); comment >= 0 {
+		text = strings.TrimSpace(text[:comment])
+	}
+
+	if strings.Contains(text, ": ") || strings.HasSuffix(text, ":") {
+		return "", fmt.Errorf("nested maps aren't supported, quote the value if it's a string")
+	}
+
+	return text, nil
+}
+
+// The index of the quote closing the quoted string text starts with, -1 if there isn't
+// one.  A single quoted string escapes its quote by doubling it, a double quoted one with
+// a backslash.
+func closingQuote(text string) int {
+	for index := 1; index < len(text); index++ {
+		switch {
+		case text[0] == '"' && text[index] == '\\':
+			index++
+		case text[index] != text[0]:
+		case text[0] == '\'' && index+1 < len(text) && text[index+1] == '\'':
+			index++
+		default:
+			return index
+		}
+	}
+
+	return -1
+}
+
+// Returns the effective value of every option, with secrets and URL credentials redacted.
+func effectiveOptions() map[string]string {
+	options := make(map[string]string)
+
+	flag.VisitAll(func(option *flag.Flag) {
+		value := option.Value.String()
+		if SECRETOPTIONS[option.Name] && value != "" {
+			value = "[redacted]"
+		}
+		value = urlUserinfo.ReplaceAllString(value, "${1}[redacted]@")
+
+		options[option.Name] = value
+	})
+
+	return options
+}
+
+// GET /config
+func showConfig(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		respondError(writer, http.StatusMethodNotAllowed, "only GET is supported")
+		return
+	}
+
+	body, err := json.MarshalIndent(effectiveOptions(), "", "  ")
+	if err != nil {
+		respondError(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writeLine(writer, body)
+}
@@ -0,0 +1,80 @@
+package main
+
+import "bytes"
+import "encoding/csv"
+import "errors"
+import "fmt"
+import "io"
+import "strings"
+import "unicode/utf8"
+
+// How a decompressed dataFile is interpreted: auto, csv or text.
+var DATAFILEFORMAT string
+
+// The number of rows shown from a csv dataFile, after the header.
+const CSVROWS = 5
+
+// Whether data looks like csv: text whose first lines split into the same number of
+// comma separated fields, more than one.
+func looksLikeCSV(data []byte) bool {
+	if !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0 {
+		return false
+	}
+
+	reader := csv.NewReader(bytes.NewReader(data))
+
+	fields := 0
+	for line := 0; line < CSVROWS+1; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil || len(record) < 2 {
+			return false
+		}
+
+		fields = len(record)
+	}
+
+	return fields > 1
+}
+
+// Log the size and header of a csv dataFile, returning its first rows for display, or nil
+// if it isn't valid csv.
+func displayCSV(data []byte, entry *RequestEntry) []byte {
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		var parseError *csv.ParseError
+		if errors.As(err, &parseError) {
+			lines := strings.Split(string(data), "\n")
+			if parseError.Line > 0 && parseError.Line <= len(lines) {
+				entry.logError("dataFile is not valid csv: %s: %q", err, strings.TrimSuffix(lines[parseError.Line-1], "\r"))
+				return nil
+			}
+		}
+
+		entry.logError("dataFile is not valid csv: %s", err)
+		return nil
+	}
+
+	if len(records) == 0 {
+		fmt.Fprintf(&entry.output, "# csv: empty\n")
+		return data
+	}
+
+	fmt.Fprintf(&entry.output, "# csv: %d rows, %d columns\n", len(records)-1, len(records[0]))
+	fmt.Fprintf(&entry.output, "# csv header: %s\n", strings.Join(records[0], ", "))
+
+	shown := records[1:]
+	if len(shown) > CSVROWS {
+		fmt.Fprintf(&entry.output, "# Note: showing the first %d rows\n", CSVROWS)
+		shown = shown[:CSVROWS]
+	}
+
+	var output bytes.Buffer
+	writer := csv.NewWriter(&output)
+	writer.WriteAll(shown)
+
+	return output.Bytes()
+}
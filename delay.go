@@ -0,0 +1,150 @@
+package main
+
+import "context"
+import "fmt"
+import "io"
+import "math/rand"
+import "strings"
+import "sync"
+import "time"
+
+var DELAYDIST string
+var DELAYSEED int64
+var DELAYPERMB time.Duration
+var MAXDELAY time.Duration
+var READDELAY time.Duration
+
+// The most read from a request body between -read-delay-per-chunk sleeps.
+const READCHUNK = 32 << 10
+
+// A response delay distribution parsed from -delay-dist.
+type delayDistribution struct {
+	kind   string
+	first  time.Duration
+	second time.Duration
+}
+
+var DELAY delayDistribution
+
+var delayRandom *rand.Rand
+var delayLock sync.Mutex
+
+// Parse 'fixed:D', 'uniform:MIN-MAX' or 'normal:MEAN-STDDEV', where each value is a
+// duration such as 200ms.
+func parseDelayDist(spec string) (delayDistribution, error) {
+	var dist delayDistribution
+
+	kind, values, _ := strings.Cut(spec, ":")
+	dist.kind = kind
+
+	var err error
+	switch kind {
+	case "fixed":
+		dist.first, err = time.ParseDuration(values)
+
+	case "uniform", "normal":
+		first, second, found := strings.Cut(values, "-")
+		if !found {
+			return dist, fmt.Errorf("%s needs two durations separated by '-'", kind)
+		}
+
+		dist.first, err = time.ParseDuration(first)
+		if err == nil {
+			dist.second, err = time.ParseDuration(second)
+		}
+
+		if err == nil && kind == "uniform" && dist.second < dist.first {
+			err = fmt.Errorf("uniform maximum is less than the minimum")
+		}
+
+	default:
+		return dist, fmt.Errorf("unknown distribution '%s'", kind)
+	}
+
+	if err == nil && (dist.first < 0 || dist.second < 0) {
+		err = fmt.Errorf("negative duration")
+	}
+
+	return dist, err
+}
+
+// Pick a delay, never less than zero.
+func (dist delayDistribution) sample() time.Duration {
+	delayLock.Lock()
+	defer delayLock.Unlock()
+
+	if delayRandom == nil {
+		delayRandom = rand.New(rand.NewSource(DELAYSEED))
+	}
+
+	var delay time.Duration
+	switch dist.kind {
+	case "fixed":
+		delay = dist.first
+
+	case "uniform":
+		delay = dist.first + time.Duration(delayRandom.Int63n(int64(dist.second-dist.first)+1))
+
+	case "normal":
+		delay = dist.first + time.Duration(delayRandom.NormFloat64()*float64(dist.second))
+	}
+
+	if delay < 0 {
+		return 0
+	}
+
+	return delay
+}
+
+// Sleep for the delay, returning false if the context ends first.
+func sleepContext(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// The -delay-per-mb delay for a payload of size decompressed bytes, capped at -max-delay.
+func sizeDelay(size int) time.Duration {
+	delay := time.Duration(float64(DELAYPERMB) * float64(size) / 1e6)
+	if MAXDELAY > 0 && delay > MAXDELAY {
+		return MAXDELAY
+	}
+
+	return delay
+}
+
+// Reads a request body in READCHUNK byte chunks, sleeping before each, and fails once the
+// request's context ends.
+type slowReader struct {
+	io.ReadCloser
+	ctx context.Context
+
+	// Bytes left to read before the next sleep.
+	left int
+}
+
+func (reader *slowReader) Read(buffer []byte) (int, error) {
+	if reader.left == 0 {
+		if !sleepContext(reader.ctx, READDELAY) {
+			return 0, reader.ctx.Err()
+		}
+
+		reader.left = READCHUNK
+	}
+
+	if len(buffer) > reader.left {
+		buffer = buffer[:reader.left]
+	}
+
+	read, err := reader.ReadCloser.Read(buffer)
+	reader.left -= read
+
+	return read, err
+}
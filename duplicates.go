@@ -0,0 +1,67 @@
+package main
+
+import "bytes"
+import "crypto/sha256"
+import "encoding/json"
+import "mime"
+import "net/http"
+import "strconv"
+import "sync"
+import "time"
+
+// Answer a body already received within -duplicate-window with a 409.
+var REJECTDUPLICATES bool
+var DUPLICATEWINDOW time.Duration
+
+// The first request seen with each body hash, and when.
+type firstSeen struct {
+	seq  int64
+	time time.Time
+}
+
+var seenBodies = make(map[[sha256.Size]byte]firstSeen)
+var seenBodiesLock sync.Mutex
+
+// The seq of the earlier request within -duplicate-window that had the same body, or 0.
+// Multipart boundaries are left out of the hash, since clients pick a new one each time.
+func duplicateOf(entry *RequestEntry, body []byte, contentType string) int64 {
+	if len(body) == 0 {
+		return 0
+	}
+
+	_, params, _ := mime.ParseMediaType(contentType)
+	if boundary := params["boundary"]; boundary != "" {
+		body = bytes.ReplaceAll(body, []byte(boundary), nil)
+	}
+	sum := sha256.Sum256(body)
+
+	seenBodiesLock.Lock()
+	defer seenBodiesLock.Unlock()
+
+	for key, seen := range seenBodies {
+		if entry.Time.Sub(seen.time) > DUPLICATEWINDOW {
+			delete(seenBodies, key)
+		}
+	}
+
+	seen, found := seenBodies[sum]
+	if found {
+		return seen.seq
+	}
+
+	seenBodies[sum] = firstSeen{entry.Seq, entry.Time}
+
+	return 0
+}
+
+func respondDuplicate(writer http.ResponseWriter, original int64) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"success":      "false",
+		"error":        "duplicate of request " + strconv.FormatInt(original, 10),
+		"original_seq": original,
+	})
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusConflict)
+	writeLine(writer, body)
+}
@@ -0,0 +1,122 @@
+package main
+
+import "bytes"
+import "fmt"
+import "sync"
+import "sync/atomic"
+import "time"
+
+// A multipart file part as received, with its decoded data.
+type FileEntry struct {
+	Field    string              `json:"field"`
+	Filename string              `json:"filename"`
+	Size     int64               `json:"size"`
+	Header   map[string][]string `json:"header"`
+	Data     string              `json:"data,omitempty"`
+
+	// With -hash-algo, the hash of the part as received and of the decompressed dataFile.
+	Hash        string `json:"hash,omitempty"`
+	DecodedHash string `json:"decoded_hash,omitempty"`
+
+	// The name, comment and modification time from a gzipped part's header, if it set any.
+	Gzip *GzipHeader `json:"gzip,omitempty"`
+}
+
+type GzipHeader struct {
+	Name    string     `json:"name,omitempty"`
+	Comment string     `json:"comment,omitempty"`
+	ModTime *time.Time `json:"mod_time,omitempty"`
+}
+
+// A summary of a received request and its decoded payload.
+type RequestEntry struct {
+	Seq    int64                          `json:"seq"`
+	Time   time.Time                      `json:"time"`
+	Method string                         `json:"method"`
+	URL    string                         `json:"url"`
+	Host   string                         `json:"host"`
+	Proto  string                         `json:"proto"`
+	Client string                         `json:"client"`
+	Header map[string][]string            `json:"header"`
+	Range  *ContentRange                  `json:"range,omitempty"`
+	Files  []FileEntry                    `json:"files,omitempty"`
+	Values map[string][]map[string]string `json:"values,omitempty"`
+	Body   string                         `json:"body,omitempty"`
+
+	// The verified client certificate's subject and serial number, under -client-ca.
+	CertSubject string `json:"cert_subject,omitempty"`
+	CertSerial  string `json:"cert_serial,omitempty"`
+
+	// Body bytes left over by form and multipart parsing, under -trailer-format hex or base64.
+	Trailer string `json:"trailer,omitempty"`
+
+	// Problems found while decoding the payload.
+	Errors []string `json:"errors,omitempty"`
+
+	// The declared Content-Length, -1 if there wasn't one, and the body bytes actually read.
+	ContentLength int64 `json:"content_length"`
+	BytesRead     int64 `json:"bytes_read"`
+
+	// Total decompressed size of all dataFile parts.
+	DataFileBytes int `json:"datafile_bytes"`
+
+	// Time spent processing the request, not counting writing the response.
+	DurationMS float64 `json:"duration_ms"`
+
+	// The response sent, once the request is finished.
+	Status         int                 `json:"status,omitempty"`
+	ResponseHeader map[string][]string `json:"response_header,omitempty"`
+
+	// Time spent in each of STAGES.
+	stages map[string]time.Duration
+
+	// Whole decoded payloads, for -store-decoded.
+	decoded []decodedPart
+
+	// The decompressed dataFile contents, for ?echo=true.
+	echoRequested bool
+	echo          []byte
+
+	// The request's block of log lines, written to OUTPUT in one go so blocks from
+	// concurrent requests don't interleave.
+	output bytes.Buffer
+}
+
+// The number of items received, whether as 'item' values or as a raw json body.
+func (entry *RequestEntry) ItemCount() int {
+	return len(entry.Values["item"]) + len(entry.Values["body"])
+}
+
+// Print an error in the request block and keep it on the entry.
+func (entry *RequestEntry) logError(format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+
+	if ERRORSTOSTDERR {
+		fmt.Fprintf(ERRORS, "# Error in request %d: %s\n", entry.Seq, message)
+	} else {
+		fmt.Fprintf(&entry.output, "# Error %s\n", message)
+	}
+	entry.Errors = append(entry.Errors, message)
+}
+
+var outputLock sync.Mutex
+
+// Write the request's block so far to OUTPUT in a single call.
+func (entry *RequestEntry) flushOutput() {
+	outputLock.Lock()
+	defer outputLock.Unlock()
+
+	OUTPUT.Write(entry.output.Bytes())
+	entry.output.Reset()
+}
+
+// Numbers requests in the order they arrive, starting at 1.
+var requestSeq int64
+
+func newRequestEntry() *RequestEntry {
+	return &RequestEntry{
+		Seq:    atomic.AddInt64(&requestSeq, 1),
+		Time:   time.Now(),
+		Values: make(map[string][]map[string]string),
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import "crypto/subtle"
+import "encoding/json"
+import "fmt"
+import "math/rand"
+import "net/http"
+import "strconv"
+import "sync"
+import "sync/atomic"
+import "time"
+
+var FAILRATE float64
+var FAILSTATUS int
+var FAULTDELAY time.Duration
+var ADMINTOKEN string
+var FAILAFTERREQUESTS int64
+var FAILAFTERDURATION time.Duration
+var ABORTRATE float64
+
+// The live fault injection settings, as read and written by /admin/faults.
+type faultSettings struct {
+	FailRate float64 `json:"fail_rate"`
+	Delay    string  `json:"delay"`
+	Status   int     `json:"status"`
+}
+
+var faults faultSettings
+var faultDelay time.Duration
+var faultLock sync.RWMutex
+
+// For -fail-after-requests and -fail-after-duration: requests seen and when counting
+// started.  Failures are only injected once degraded is set.
+var faultRequests int64
+var faultStart time.Time
+var degraded int32
+
+// Check and apply new fault settings.
+func setFaults(settings faultSettings) error {
+	if settings.FailRate < 0 || settings.FailRate > 1 {
+		return fmt.Errorf("fail_rate must be between 0 and 1")
+	}
+
+	if settings.Status < 400 || settings.Status > 599 {
+		return fmt.Errorf("status must be between 400 and 599")
+	}
+
+	delay, err := time.ParseDuration(settings.Delay)
+	if err != nil || delay < 0 {
+		return fmt.Errorf("invalid delay '%s'", settings.Delay)
+	}
+
+	faultLock.Lock()
+	defer faultLock.Unlock()
+
+	settings.Delay = delay.String()
+	faults = settings
+	faultDelay = delay
+
+	return nil
+}
+
+func currentFaults() (faultSettings, time.Duration) {
+	faultLock.RLock()
+	defer faultLock.RUnlock()
+
+	return faults, faultDelay
+}
+
+// Decide whether to fail this request.  Returns the status to fail with, or 0, and the
+// extra delay before responding.
+func injectFault() (int, time.Duration) {
+	settings, delay := currentFaults()
+
+	if !isDegraded(settings.FailRate) {
+		return 0, delay
+	}
+
+	if settings.FailRate > 0 && rand.Float64() < settings.FailRate {
+		return settings.Status, delay
+	}
+
+	return 0, delay
+}
+
+// Whether the -fail-after thresholds have been crossed, logging when they first are.
+// Always true when there aren't any.
+func isDegraded(failRate float64) bool {
+	if atomic.LoadInt32(&degraded) == 1 {
+		return true
+	}
+
+	requests := atomic.AddInt64(&faultRequests, 1)
+	elapsed := time.Since(faultStart)
+
+	var reason string
+	switch {
+	case FAILAFTERREQUESTS == 0 && FAILAFTERDURATION == 0:
+		atomic.StoreInt32(&degraded, 1)
+		return true
+
+	case FAILAFTERREQUESTS > 0 && requests > FAILAFTERREQUESTS:
+		reason = fmt.Sprintf("%d requests", FAILAFTERREQUESTS)
+
+	case FAILAFTERDURATION > 0 && elapsed >= FAILAFTERDURATION:
+		reason = FAILAFTERDURATION.String()
+
+	default:
+		return false
+	}
+
+	if atomic.CompareAndSwapInt32(&degraded, 0, 1) {
+		fmt.Fprintf(OUTPUT, "# fault injection: degraded after %s, now failing %g%% of requests\n", reason, failRate*100)
+	}
+
+	return true
+}
+
+// GET or POST /admin/faults, with 'Authorization: Bearer <-admin-token>'.
+func adminFaults(writer http.ResponseWriter, request *http.Request) {
+	token := []byte("Bearer " + ADMINTOKEN)
+	if subtle.ConstantTimeCompare([]byte(request.Header.Get("Authorization")), token) != 1 {
+		respondError(writer, http.StatusUnauthorized, "missing or wrong admin token")
+		return
+	}
+
+	switch request.Method {
+	case http.MethodGet:
+
+	case http.MethodPost:
+		// Fields left out keep their current values.
+		settings, _ := currentFaults()
+
+		err := json.NewDecoder(request.Body).Decode(&settings)
+		if err == nil {
+			err = setFaults(settings)
+		}
+
+		if err != nil {
+			respondError(writer, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		settings, _ = currentFaults()
+		fmt.Fprintf(OUTPUT, "# faults set: fail_rate=%g delay=%s status=%d\n",
+			settings.FailRate, settings.Delay, settings.Status)
+
+	default:
+		respondError(writer, http.StatusMethodNotAllowed, "only GET and POST are supported")
+		return
+	}
+
+	settings, _ := currentFaults()
+	body, _ := json.Marshal(settings)
+
+	writer.Header().Set("Content-Type", "application/json")
+	writeLine(writer, body)
+}
+
+// Whether to hang up on this request, for -abort-rate.
+func shouldAbort() bool {
+	return ABORTRATE > 0 && rand.Float64() < ABORTRATE
+}
+
+// Send the start of a success response and then drop the connection.  HTTP/1 connections
+// are hijacked and closed outright; where that isn't possible, such as over HTTP/2, the
+// handler panics with http.ErrAbortHandler, which makes net/http reset the stream.  Under
+// -async there is no connection left to drop, and acceptAsync recovers the panic.
+func abortResponse(writer http.ResponseWriter) {
+	partial := FILLER[:len(FILLER)/2]
+
+	conn, buffered, err := http.NewResponseController(writer).Hijack()
+	if err == nil {
+		fmt.Fprintf(buffered, "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s",
+			len(FILLER), partial)
+		buffered.Flush()
+		conn.Close()
+		return
+	}
+
+	writer.Header().Set("Content-Length", strconv.Itoa(len(FILLER)))
+	writer.Write([]byte(partial))
+	http.NewResponseController(writer).Flush()
+
+	panic(http.ErrAbortHandler)
+}
@@ -0,0 +1,74 @@
+package main
+
+import "bytes"
+import "fmt"
+import "io"
+import "net/http"
+import "time"
+
+var FORWARD string
+
+var forwardClient = &http.Client{Timeout: 30 * time.Second}
+
+// Headers that only apply to a single connection and are never passed on.
+var HOPHEADERS = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func removeHopHeaders(header http.Header) {
+	for _, key := range HOPHEADERS {
+		header.Del(key)
+	}
+}
+
+// Send a copy of the request to -forward, logging the result.  Returns nil if the
+// upstream couldn't be reached.
+func forward(output io.Writer, request *http.Request, body []byte) *http.Response {
+	upstream, err := http.NewRequestWithContext(request.Context(), request.Method, FORWARD,
+		bytes.NewReader(body))
+	if err != nil {
+		fmt.Fprintf(requestErrors(output), "# Error building upstream request: %s\n", err)
+		return nil
+	}
+
+	upstream.Header = request.Header.Clone()
+	removeHopHeaders(upstream.Header)
+
+	response, err := forwardClient.Do(upstream)
+	if err != nil {
+		fmt.Fprintf(requestErrors(output), "# Error forwarding to %s: %s\n", FORWARD, err)
+		return nil
+	}
+
+	fmt.Fprintf(output, "# forwarded to %s: %s\n", FORWARD, response.Status)
+
+	return response
+}
+
+// Pass the upstream response back to the client, or a 502 if there wasn't one.
+func relay(writer http.ResponseWriter, response *http.Response) {
+	if response == nil {
+		respondError(writer, http.StatusBadGateway, "upstream request failed")
+		return
+	}
+
+	for key, values := range response.Header {
+		writer.Header()[key] = values
+	}
+	removeHopHeaders(writer.Header())
+
+	writer.WriteHeader(response.StatusCode)
+
+	_, err := io.Copy(newFlushWriter(writer), response.Body)
+	if err != nil {
+		fmt.Fprintf(ERRORS, "Error relaying upstream response: %s\n", err)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import "encoding/json"
+import "mime"
+import "net/http"
+import "net/url"
+import "sort"
+import "time"
+
+// HTTP Archive 1.2, as much of it as the kept requests can fill in.
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harPostData struct {
+	MimeType string     `json:"mimeType"`
+	Params   []harParam `json:"params"`
+	Text     string     `json:"text"`
+}
+
+type harParam struct {
+	Name        string `json:"name"`
+	Value       string `json:"value,omitempty"`
+	FileName    string `json:"fileName,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+func harHeaders(header map[string][]string) []harNameValue {
+	headers := []harNameValue{}
+	for key, values := range header {
+		for _, value := range values {
+			headers = append(headers, harNameValue{key, value})
+		}
+	}
+
+	sort.Slice(headers, func(first, second int) bool {
+		return headers[first].Name < headers[second].Name
+	})
+
+	return headers
+}
+
+// The decoded payload as HAR post data: values and files as params, a raw body as text.
+func harPayload(entry *RequestEntry) *harPostData {
+	if len(entry.Values) == 0 && len(entry.Files) == 0 && entry.Body == "" {
+		return nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(http.Header(entry.Header).Get("Content-Type"))
+	postData := &harPostData{MimeType: mediaType, Params: []harParam{}, Text: entry.Body}
+
+	if entry.Body == "" {
+		for key, values := range entry.Values {
+			for _, value := range values {
+				encoded, _ := json.Marshal(value)
+				postData.Params = append(postData.Params, harParam{Name: key, Value: string(encoded)})
+			}
+		}
+
+		sort.SliceStable(postData.Params, func(first, second int) bool {
+			return postData.Params[first].Name < postData.Params[second].Name
+		})
+	}
+
+	for _, file := range entry.Files {
+		postData.Params = append(postData.Params, harParam{
+			Name:        file.Field,
+			Value:       file.Data,
+			FileName:    file.Filename,
+			ContentType: http.Header(file.Header).Get("Content-Type"),
+		})
+	}
+
+	return postData
+}
+
+func harEntryFor(entry *RequestEntry) harEntry {
+	target := &url.URL{Scheme: "http", Host: entry.Host}
+	if parsed, err := url.Parse(entry.URL); err == nil {
+		target = target.ResolveReference(parsed)
+	}
+
+	query := []harNameValue{}
+	for key, values := range target.Query() {
+		for _, value := range values {
+			query = append(query, harNameValue{key, value})
+		}
+	}
+
+	proto := entry.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+
+	status := entry.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	return harEntry{
+		StartedDateTime: entry.Time.Format(time.RFC3339Nano),
+		Time:            entry.DurationMS,
+		Request: harRequest{
+			Method:      entry.Method,
+			URL:         target.String(),
+			HTTPVersion: proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(entry.Header),
+			QueryString: query,
+			PostData:    harPayload(entry),
+			HeadersSize: -1,
+			BodySize:    entry.BytesRead,
+		},
+		Response: harResponse{
+			Status:      status,
+			StatusText:  http.StatusText(status),
+			HTTPVersion: proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(entry.ResponseHeader),
+			Content: harContent{
+				Size:     -1,
+				MimeType: http.Header(entry.ResponseHeader).Get("Content-Type"),
+			},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Timings: harTimings{Wait: entry.DurationMS},
+	}
+}
+
+// GET /export/har, the kept requests as an HTTP Archive.
+func exportHAR(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		respondError(writer, http.StatusMethodNotAllowed, "only GET is supported")
+		return
+	}
+
+	log := harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "fake_bsg_datastore", Version: "1.0"},
+		Entries: []harEntry{},
+	}
+
+	for _, entry := range rememberedRequests() {
+		log.Entries = append(log.Entries, harEntryFor(entry))
+	}
+
+	body, err := json.MarshalIndent(map[string]harLog{"log": log}, "", "  ")
+	if err != nil {
+		respondError(writer, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("Content-Disposition", "attachment; filename=\"datastore.har\"")
+	writeLine(writer, body)
+}
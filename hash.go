@@ -0,0 +1,117 @@
+package main
+
+import "crypto/sha256"
+import "encoding/base64"
+import "encoding/hex"
+import "fmt"
+import "hash"
+import "hash/crc32"
+import "io"
+import "strings"
+
+// The fingerprint computed for each file part: none, sha256 or crc32.
+var HASHALGO string
+
+// The part header carrying the client's own SHA-256 of the part.
+const CONTENTSHA256 = "X-Content-SHA256"
+
+func newHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case "sha256":
+		return sha256.New()
+	case "crc32":
+		return crc32.NewIEEE()
+	}
+
+	return nil
+}
+
+// "sha256:<hex>"
+func formatHash(algorithm string, sum []byte) string {
+	return algorithm + ":" + hex.EncodeToString(sum)
+}
+
+func hashOf(algorithm string, data []byte) []byte {
+	digest := newHash(algorithm)
+	digest.Write(data)
+
+	return digest.Sum(nil)
+}
+
+// Hashes a part's raw bytes as they're read: with -hash-algo, and with SHA-256 when the
+// part declares X-Content-SHA256.
+type partHasher struct {
+	io.ReadCloser
+	chosen hash.Hash
+	sha256 hash.Hash
+}
+
+func newPartHasher(part io.ReadCloser, declared string) *partHasher {
+	hasher := &partHasher{ReadCloser: part, chosen: newHash(HASHALGO)}
+	if declared != "" {
+		hasher.sha256 = sha256.New()
+	}
+
+	return hasher
+}
+
+func (hasher *partHasher) Read(buffer []byte) (int, error) {
+	read, err := hasher.ReadCloser.Read(buffer)
+
+	if hasher.chosen != nil {
+		hasher.chosen.Write(buffer[:read])
+	}
+	if hasher.sha256 != nil {
+		hasher.sha256.Write(buffer[:read])
+	}
+
+	return read, err
+}
+
+// Whether a declared X-Content-SHA256, in hex or base64, matches one of the sums.
+func matchesDeclared(declared string, sums ...[]byte) bool {
+	declared = strings.TrimPrefix(strings.TrimSpace(declared), "sha256=")
+
+	for _, sum := range sums {
+		if sum == nil {
+			continue
+		}
+
+		if strings.EqualFold(declared, hex.EncodeToString(sum)) ||
+			declared == base64.StdEncoding.EncodeToString(sum) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Log and keep the part's hashes, and warn if they don't match what the client declared.
+// decoded is the whole decompressed dataFile, or nil.
+func checkPartHashes(output io.Writer, hasher *partHasher, declared string, decoded []byte, file *FileEntry) {
+	if hasher.chosen != nil {
+		file.Hash = formatHash(HASHALGO, hasher.chosen.Sum(nil))
+		fmt.Fprintf(output, "# %s\n", file.Hash)
+
+		if decoded != nil {
+			file.DecodedHash = formatHash(HASHALGO, hashOf(HASHALGO, decoded))
+			fmt.Fprintf(output, "# decoded %s\n", file.DecodedHash)
+		}
+	}
+
+	if declared == "" {
+		return
+	}
+
+	var decodedSum []byte
+	if decoded != nil {
+		decodedSum = hashOf("sha256", decoded)
+	}
+
+	if matchesDeclared(declared, hasher.sha256.Sum(nil), decodedSum) {
+		fmt.Fprintf(output, "# %s matches\n", CONTENTSHA256)
+	} else {
+		fmt.Fprintf(output, "# WARNING: %s mismatch: declared %s, computed %s\n",
+			CONTENTSHA256, declared, hex.EncodeToString(hasher.sha256.Sum(nil)))
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import "fmt"
+import "net/http"
+import "strings"
+
+var RESPONSEHEADERS stringList
+var CACHECONTROL string
+var REFLECTHEADERS string
+
+// A -response-header, sent on responses in its scope: "success" for statuses below 400,
+// "error" for the rest, or "" for all.
+type responseHeader struct {
+	scope string
+	key   string
+	value string
+}
+
+var responseHeaders []responseHeader
+
+// Parse the -response-header values, each "Key: Value", optionally prefixed with
+// "success:" or "error:".
+func parseResponseHeaders(values []string) ([]responseHeader, error) {
+	var headers []responseHeader
+
+	for _, value := range values {
+		var header responseHeader
+
+		prefix, rest, found := strings.Cut(value, ":")
+		if found && (strings.EqualFold(prefix, "success") || strings.EqualFold(prefix, "error")) {
+			header.scope = strings.ToLower(prefix)
+			value = rest
+		}
+
+		key, headerValue, found := strings.Cut(value, ":")
+		key = strings.TrimSpace(key)
+		if !found || key == "" {
+			return nil, fmt.Errorf("expected 'Key: Value', got '%s'", value)
+		}
+
+		header.key = key
+		header.value = strings.TrimSpace(headerValue)
+		headers = append(headers, header)
+	}
+
+	return headers, nil
+}
+
+// Adds the -response-header headers in scope for the status once it's known.
+type headerWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (writer *headerWriter) WriteHeader(status int) {
+	if !writer.wroteHeader {
+		writer.wroteHeader = true
+
+		scope := "success"
+		if status >= 400 {
+			scope = "error"
+		}
+
+		for _, header := range responseHeaders {
+			if header.scope == "" || header.scope == scope {
+				writer.Header().Add(header.key, header.value)
+			}
+		}
+	}
+
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+func (writer *headerWriter) Write(data []byte) (int, error) {
+	if !writer.wroteHeader {
+		writer.WriteHeader(http.StatusOK)
+	}
+
+	return writer.ResponseWriter.Write(data)
+}
+
+// Send whatever has been written so far.  Writes the header first, so an unanswered
+// request gets the usual 200.
+func (writer *headerWriter) Flush() {
+	writer.FlushError()
+}
+
+// Flush, returning why it couldn't, for http.ResponseController.
+func (writer *headerWriter) FlushError() error {
+	if !writer.wroteHeader {
+		writer.WriteHeader(http.StatusOK)
+	}
+
+	return http.NewResponseController(writer.ResponseWriter).Flush()
+}
+
+func (writer *headerWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
+
+// Set Cache-Control before handling: -cache-control for GET and HEAD requests, which
+// default to no-store as every endpoint serves live data, and always no-store otherwise.
+func cacheControl(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		value := "no-store"
+		if request.Method == http.MethodGet || request.Method == http.MethodHead {
+			value = CACHECONTROL
+		}
+
+		writer.Header().Set("Cache-Control", value)
+		handler(writer, request)
+	}
+}
+
+// Copy the request headers starting with -reflect-headers into the response, leaving out
+// hop-by-hop headers, including any the request's Connection header names.
+func reflectHeaders(writer http.ResponseWriter, request *http.Request) {
+	reflected := make(http.Header)
+	for key, values := range request.Header {
+		if len(key) >= len(REFLECTHEADERS) && strings.EqualFold(key[:len(REFLECTHEADERS)], REFLECTHEADERS) {
+			reflected[key] = values
+		}
+	}
+
+	removeHopHeaders(reflected)
+	for _, value := range request.Header.Values("Connection") {
+		for _, key := range strings.Split(value, ",") {
+			reflected.Del(strings.TrimSpace(key))
+		}
+	}
+
+	for key, values := range reflected {
+		writer.Header()[key] = values
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import "encoding/json"
+import "mime"
+import "net/http"
+import "net/url"
+import "strings"
+import "sync"
+
+// The number of recent requests kept in memory for /assert and /requests.
+var HISTORY int
+
+var history []*RequestEntry
+var historyLock sync.Mutex
+
+// Keep a finished request, dropping the oldest past -history.
+func remember(entry *RequestEntry) {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+
+	history = append(history, entry)
+	if len(history) > HISTORY {
+		history = history[len(history)-HISTORY:]
+	}
+}
+
+// The kept requests, oldest first.
+func rememberedRequests() []*RequestEntry {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+
+	return append([]*RequestEntry(nil), history...)
+}
+
+// What POST /assert looks for.  Empty fields match anything.  A header value of "*"
+// matches any value, as long as the header is present.
+type requestMatcher struct {
+	Method  string            `json:"method"`
+	Path    string            `json:"path"`
+	Headers map[string]string `json:"headers"`
+	Item    map[string]string `json:"item"`
+}
+
+func (matcher *requestMatcher) matches(entry *RequestEntry) bool {
+	if matcher.Method != "" && matcher.Method != entry.Method {
+		return false
+	}
+
+	if matcher.Path != "" {
+		parsed, err := url.Parse(entry.URL)
+		if err != nil || parsed.Path != matcher.Path {
+			return false
+		}
+	}
+
+	for key, want := range matcher.Headers {
+		values := entry.Header[http.CanonicalHeaderKey(key)]
+		if !containsValue(values, want) {
+			return false
+		}
+	}
+
+	if len(matcher.Item) == 0 {
+		return true
+	}
+
+	for _, key := range []string{"item", "body"} {
+		for _, item := range entry.Values[key] {
+			if matchesFields(item, matcher.Item) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func containsValue(values []string, want string) bool {
+	for _, value := range values {
+		if want == "*" || value == want {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchesFields(item map[string]string, fields map[string]string) bool {
+	for key, want := range fields {
+		value, ok := item[key]
+		if !ok || value != want {
+			return false
+		}
+	}
+
+	return true
+}
+
+// POST /assert with a requestMatcher, answering with the number of kept requests that
+// match it, or a 404 if none do.
+func assertRequests(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		respondError(writer, http.StatusMethodNotAllowed, "only POST is supported")
+		return
+	}
+
+	var matcher requestMatcher
+	err := json.NewDecoder(request.Body).Decode(&matcher)
+	if err != nil {
+		respondError(writer, http.StatusBadRequest, "invalid matcher: "+err.Error())
+		return
+	}
+
+	count := 0
+	for _, entry := range rememberedRequests() {
+		if matcher.matches(entry) {
+			count++
+		}
+	}
+
+	body, _ := json.Marshal(map[string]int{"count": count})
+
+	writer.Header().Set("Content-Type", "application/json")
+	if count == 0 {
+		writer.WriteHeader(http.StatusNotFound)
+	}
+	writeLine(writer, body)
+}
+
+// Whether the client asked for ndjson, with ?format=ndjson or Accept: application/x-ndjson.
+// ?format=json asks for the array whatever Accept says.
+func wantsNDJSON(request *http.Request) bool {
+	switch request.URL.Query().Get("format") {
+	case "ndjson":
+		return true
+	case "json":
+		return false
+	}
+
+	for _, accepted := range strings.Split(request.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err == nil && mediaType == "application/x-ndjson" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GET /requests, the kept requests oldest first: a json array, or as ndjson one line per
+// request, each flushed as it's written.
+func listRequests(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		respondError(writer, http.StatusMethodNotAllowed, "only GET is supported")
+		return
+	}
+
+	entries := rememberedRequests()
+
+	if !wantsNDJSON(request) {
+		body, err := json.Marshal(append([]*RequestEntry{}, entries...))
+		if err != nil {
+			respondError(writer, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		writeLine(writer, body)
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/x-ndjson")
+
+	// Encode adds the newline after each entry.
+	encoder := json.NewEncoder(newFlushWriter(writer))
+	for _, entry := range entries {
+		if encoder.Encode(entry) != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import "bytes"
+import "context"
+import "encoding/json"
+import "fmt"
+import "os/exec"
+import "time"
+
+var ONREQUEST string
+var ONREQUESTTIMEOUT time.Duration
+
+// Whether a finished request runs -on-request.  -validate-only requests are only checked.
+func runsHook() bool {
+	return ONREQUEST != "" && !VALIDATEONLY
+}
+
+// Run the -on-request command with the entry as json on its stdin.  This is meant to be
+// called in its own goroutine so the response isn't held up.
+func runHook(entry *RequestEntry) {
+	input, err := json.Marshal(entry)
+	if err != nil {
+		fmt.Fprintf(requestErrors(OUTPUT), "# on-request: error encoding request: %s\n", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ONREQUESTTIMEOUT)
+	defer cancel()
+
+	command := exec.CommandContext(ctx, "sh", "-c", ONREQUEST)
+	command.Stdin = bytes.NewReader(input)
+
+	output, err := command.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		fmt.Fprintf(requestErrors(OUTPUT), "# on-request: timed out after %s\n%s", ONREQUESTTIMEOUT, output)
+		return
+	}
+
+	if err != nil {
+		fmt.Fprintf(requestErrors(OUTPUT), "# on-request: %s\n%s", err, output)
+		return
+	}
+
+	fmt.Fprintf(OUTPUT, "# on-request: exit status 0\n%s", output)
+}
@@ -0,0 +1,36 @@
+package main
+
+import "fmt"
+import "io"
+import "net/http"
+import "sync/atomic"
+import "time"
+
+var IDLETIMEOUT time.Duration
+
+// When the last request arrived, in unix nanoseconds, updated atomically.
+var lastRequest int64
+
+// Note the time of every request before handling it.
+func trackActivity(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		atomic.StoreInt64(&lastRequest, time.Now().UnixNano())
+		handler.ServeHTTP(writer, request)
+	})
+}
+
+// Close idle once no request has arrived for -idle-timeout.
+func waitIdle(output io.Writer, idle chan<- struct{}) {
+	atomic.StoreInt64(&lastRequest, time.Now().UnixNano())
+
+	for {
+		wait := IDLETIMEOUT - time.Since(time.Unix(0, atomic.LoadInt64(&lastRequest)))
+		if wait <= 0 {
+			fmt.Fprintf(output, "# exiting after %s idle\n", IDLETIMEOUT)
+			close(idle)
+			return
+		}
+
+		time.Sleep(wait)
+	}
+}
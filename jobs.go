@@ -0,0 +1,160 @@
+package main
+
+import "bytes"
+import "context"
+import "encoding/json"
+import "io/ioutil"
+import "net/http"
+import "strings"
+import "sync"
+import "time"
+
+// Answer uploads with a 202 and a /jobs/<id> to poll, decoding them in the background.
+var ASYNC bool
+
+// How long a finished job can still be polled before it's forgotten.
+var JOBTTL time.Duration
+
+type job struct {
+	ID     string `json:"id"`
+	Status string `json:"status"`
+
+	// The status display answered with once the job finished.
+	ResponseStatus int `json:"response_status,omitempty"`
+}
+
+var jobs = make(map[string]*job)
+var jobsLock sync.Mutex
+
+// Finished jobs in the order they finished, so expired ones are found from the front.
+var finishedJobs []finishedJob
+
+type finishedJob struct {
+	id       string
+	finished time.Time
+}
+
+// Forget the jobs that finished more than -job-ttl ago.  Called with jobsLock held.
+func expireJobs(now time.Time) {
+	expired := 0
+	for expired < len(finishedJobs) && now.Sub(finishedJobs[expired].finished) > JOBTTL {
+		delete(jobs, finishedJobs[expired].id)
+		expired++
+	}
+
+	finishedJobs = finishedJobs[expired:]
+}
+
+// Discards a handler's response, keeping only its status.
+type jobRecorder struct {
+	header http.Header
+	status int
+}
+
+func (recorder *jobRecorder) Header() http.Header {
+	return recorder.header
+}
+
+func (recorder *jobRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+}
+
+// Nothing is sent anywhere, so there's nothing to flush.
+func (recorder *jobRecorder) Flush() {
+}
+
+func (recorder *jobRecorder) Write(data []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+
+	return len(data), nil
+}
+
+// Read the whole upload, answer with a 202 pointing at its job, then hand a copy of the
+// request to handler once the client has its answer.  The job is done if handler answers
+// with a success status and failed otherwise.
+func acceptAsync(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		body, err := ioutil.ReadAll(request.Body)
+		if err != nil {
+			respondError(writer, http.StatusBadRequest, "reading body: "+err.Error())
+			return
+		}
+
+		pending := &job{ID: newUUID(), Status: "pending"}
+
+		jobsLock.Lock()
+		expireJobs(time.Now())
+		jobs[pending.ID] = pending
+		jobsLock.Unlock()
+
+		// The request's context ends with this handler, so the copy gets one of its own.
+		background := request.Clone(context.Background())
+		background.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		go func() {
+			recorder := &jobRecorder{header: make(http.Header)}
+
+			// Nothing here recovers like net/http's serve loop does, so an -abort-rate
+			// abort is caught here and fails the job instead of crashing the server.
+			defer func() {
+				aborted := recover()
+				if aborted != nil && aborted != http.ErrAbortHandler {
+					panic(aborted)
+				}
+
+				jobsLock.Lock()
+				defer jobsLock.Unlock()
+
+				pending.ResponseStatus = recorder.status
+				if aborted == nil && recorder.status < 400 {
+					pending.Status = "done"
+				} else {
+					pending.Status = "failed"
+				}
+
+				finishedJobs = append(finishedJobs, finishedJob{pending.ID, time.Now()})
+			}()
+
+			handler(recorder, background)
+		}()
+
+		response, _ := json.Marshal(map[string]string{"job_id": pending.ID, "status": "pending"})
+
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Header().Set("Location", "/jobs/"+pending.ID)
+		writer.WriteHeader(http.StatusAccepted)
+		writeLine(writer, response)
+	}
+}
+
+// GET /jobs/<id>, the status of an -async upload: pending, done or failed.  Jobs finished
+// more than -job-ttl ago are gone.
+func showJob(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		respondError(writer, http.StatusMethodNotAllowed, "only GET is supported")
+		return
+	}
+
+	id := strings.TrimPrefix(request.URL.Path, "/jobs/")
+
+	jobsLock.Lock()
+	expireJobs(time.Now())
+	found, ok := jobs[id]
+	var body []byte
+	if ok {
+		body, _ = json.Marshal(found)
+	}
+	jobsLock.Unlock()
+
+	if !ok {
+		respondError(writer, http.StatusNotFound, "no such job")
+		return
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writeLine(writer, body)
+}
@@ -0,0 +1,161 @@
+package main
+
+import "bytes"
+import "crypto"
+import "crypto/hmac"
+import "crypto/rsa"
+import "crypto/sha256"
+import "crypto/sha512"
+import "crypto/x509"
+import "encoding/base64"
+import "encoding/json"
+import "encoding/pem"
+import "errors"
+import "fmt"
+import "hash"
+import "io"
+import "io/ioutil"
+import "strings"
+
+var DECODEJWT bool
+var JWTKEY string
+
+// Print the header and claims of a bearer JWT, checking the signature when -jwt-key is
+// given.  The signature itself is never printed.
+func displayJWT(output io.Writer, authorization string) {
+	scheme, token, found := strings.Cut(authorization, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return
+	}
+
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		fmt.Fprintf(requestErrors(output), "# Error decoding jwt: expected 3 parts, found %d\n", len(parts))
+		return
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+	}
+
+	for index, name := range []string{"header", "payload"} {
+		data, err := base64.RawURLEncoding.DecodeString(parts[index])
+		if err != nil {
+			fmt.Fprintf(requestErrors(output), "# Error decoding jwt %s: %s\n", name, err)
+			return
+		}
+
+		var pretty bytes.Buffer
+		err = json.Indent(&pretty, data, "#\t", "  ")
+		if err != nil {
+			fmt.Fprintf(requestErrors(output), "# Error decoding jwt %s: %s\n", name, err)
+			return
+		}
+
+		if index == 0 {
+			json.Unmarshal(data, &header)
+		}
+
+		fmt.Fprintf(output, "# jwt %s:\n#\t%s\n", name, pretty.Bytes())
+	}
+
+	fmt.Fprintf(output, "# jwt signature: [redacted]\n")
+
+	if JWTKEY == "" {
+		return
+	}
+
+	err := verifyJWT(header.Algorithm, parts[0]+"."+parts[1], parts[2])
+	if err != nil {
+		fmt.Fprintf(output, "# jwt signature invalid: %s\n", err)
+		return
+	}
+
+	fmt.Fprintf(output, "# jwt signature verified\n")
+}
+
+// Check an HS256/384/512 signature against -jwt-key as a secret, or an RS256/384/512
+// signature against -jwt-key as a PEM public key file.
+func verifyJWT(algorithm string, signed string, encoded string) error {
+	signature, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return err
+	}
+
+	if len(algorithm) != 5 {
+		return fmt.Errorf("unsupported algorithm '%s'", algorithm)
+	}
+
+	var newHash func() hash.Hash
+	var cryptoHash crypto.Hash
+
+	switch algorithm[2:] {
+	case "256":
+		newHash, cryptoHash = sha256.New, crypto.SHA256
+	case "384":
+		newHash, cryptoHash = sha512.New384, crypto.SHA384
+	case "512":
+		newHash, cryptoHash = sha512.New, crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm '%s'", algorithm)
+	}
+
+	switch {
+	case strings.HasPrefix(algorithm, "HS"):
+		mac := hmac.New(newHash, []byte(JWTKEY))
+		mac.Write([]byte(signed))
+
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("signature mismatch")
+		}
+
+		return nil
+
+	case strings.HasPrefix(algorithm, "RS"):
+		key, err := loadRSAKey(JWTKEY)
+		if err != nil {
+			return err
+		}
+
+		digest := newHash()
+		digest.Write([]byte(signed))
+
+		return rsa.VerifyPKCS1v15(key, cryptoHash, digest.Sum(nil), signature)
+	}
+
+	return fmt.Errorf("unsupported algorithm '%s'", algorithm)
+}
+
+func loadRSAKey(path string) (*rsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", path)
+	}
+
+	var parsed interface{}
+	if block.Type == "CERTIFICATE" {
+		var certificate *x509.Certificate
+		certificate, err = x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			parsed = certificate.PublicKey
+		}
+	} else {
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := parsed.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an RSA public key", path)
+	}
+
+	return key, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import "encoding/json"
+import "fmt"
+import "net/http"
+import "sync"
+
+// How many entries may queue for a /live subscriber before newer ones are dropped.
+const LIVEBUFFER = 64
+
+// A /live websocket waiting for entries.
+type subscriber struct {
+	entries chan []byte
+	dropped int
+}
+
+var subscribers = make(map[*subscriber]bool)
+var subscribersLock sync.Mutex
+
+// Send a finished entry to every /live subscriber, dropping it for any that are behind.
+func publish(entry *RequestEntry) {
+	subscribersLock.Lock()
+	defer subscribersLock.Unlock()
+
+	if len(subscribers) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	for subscriber := range subscribers {
+		select {
+		case subscriber.entries <- data:
+		default:
+			subscriber.dropped++
+		}
+	}
+}
+
+func subscribe() *subscriber {
+	subscriber := &subscriber{entries: make(chan []byte, LIVEBUFFER)}
+
+	subscribersLock.Lock()
+	subscribers[subscriber] = true
+	subscribersLock.Unlock()
+
+	return subscriber
+}
+
+// Stop sending to a subscriber, returning how many entries it missed.
+func unsubscribe(subscriber *subscriber) int {
+	subscribersLock.Lock()
+	defer subscribersLock.Unlock()
+
+	delete(subscribers, subscriber)
+
+	return subscriber.dropped
+}
+
+// GET /live, a websocket sent each request entry as json as it's finished.
+func live(writer http.ResponseWriter, request *http.Request) {
+	client := clientIP(request)
+
+	ws, err := upgradeWebsocket(writer, request)
+	if err != nil {
+		respondError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer ws.Close()
+
+	subscriber := subscribe()
+	fmt.Fprintf(OUTPUT, "# live subscriber connected from %s\n\n", client)
+
+	// Messages from the client are ignored, but reading notices when it goes away.
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+
+		for {
+			_, _, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+send:
+	for {
+		select {
+		case data := <-subscriber.entries:
+			err = ws.WriteMessage(opText, data)
+			if err != nil {
+				break send
+			}
+
+		case <-closed:
+			break send
+		}
+	}
+
+	dropped := unsubscribe(subscriber)
+	fmt.Fprintf(OUTPUT, "# live subscriber from %s disconnected, %d entries dropped\n\n", client, dropped)
+}
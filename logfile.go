@@ -0,0 +1,83 @@
+package main
+
+import "fmt"
+import "os"
+import "sync"
+
+var LOGFILE string
+
+// The open -log-file, nil without one.
+var logFile *reopenableFile
+
+// A file opened for appending that can be opened again by path, so a log moved aside by
+// logrotate is followed by a fresh one on SIGHUP.  Truncating it in place needs nothing.
+type reopenableFile struct {
+	path string
+	lock sync.Mutex
+	file *os.File
+}
+
+func openLogFile(path string) (*reopenableFile, error) {
+	log := &reopenableFile{path: path}
+	return log, log.Reopen()
+}
+
+// Open the path again, closing the previous file once the new one is in place.
+func (log *reopenableFile) Reopen() error {
+	file, err := os.OpenFile(log.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	log.lock.Lock()
+	previous := log.file
+	log.file = file
+	log.lock.Unlock()
+
+	if previous != nil {
+		return previous.Close()
+	}
+
+	return nil
+}
+
+func (log *reopenableFile) Write(data []byte) (int, error) {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+
+	return log.file.Write(data)
+}
+
+func (log *reopenableFile) Close() error {
+	log.lock.Lock()
+	defer log.lock.Unlock()
+
+	log.file.Sync()
+	return log.file.Close()
+}
+
+// Reopen the -log-file for each signal received.  A failed reopen keeps writing to the
+// file already open.
+func reopenOnSignal(signals chan os.Signal) {
+	for range signals {
+		err := logFile.Reopen()
+		if err != nil {
+			fmt.Fprintf(ERRORS, "Error reopening log file: %s\n", err)
+			continue
+		}
+
+		fmt.Fprintf(OUTPUT, "# reopened log file %s\n\n", LOGFILE)
+	}
+}
+
+// os.Exit runs no deferred calls, so the -log-file is synced and closed first.
+func exit(code int) {
+	closeLogFile()
+	os.Exit(code)
+}
+
+func closeLogFile() {
+	if logFile != nil {
+		logFile.Close()
+	}
+}
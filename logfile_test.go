@@ -0,0 +1,33 @@
+package main
+
+import "io/ioutil"
+import "os"
+import "testing"
+
+func TestLogFileReopen(t *testing.T) {
+	path := t.TempDir() + "/server.log"
+
+	log, err := openLogFile(path)
+	if err != nil {
+		t.Fatalf("opening: %s", err)
+	}
+
+	log.Write([]byte("before\n"))
+
+	// As logrotate does: move the file aside, then signal for a new one.
+	os.Rename(path, path+".1")
+	err = log.Reopen()
+	if err != nil {
+		t.Fatalf("reopening: %s", err)
+	}
+
+	log.Write([]byte("after\n"))
+	log.Close()
+
+	for name, want := range map[string]string{path + ".1": "before\n", path: "after\n"} {
+		data, _ := ioutil.ReadFile(name)
+		if string(data) != want {
+			t.Errorf("%s holds %q, want %q", name, data, want)
+		}
+	}
+}
@@ -1,167 +1,1779 @@
 package main
 
+import "bufio"
 import "bytes"
+import "context"
 import "compress/gzip"
+import "crypto/tls"
+import "crypto/x509"
 import "encoding/base64"
+import "encoding/hex"
 import "encoding/json"
+import "errors"
 import "flag"
+import "io"
 import "io/ioutil"
 import "fmt"
+import "mime"
+import "net"
 import "net/http"
+import "net/url"
+import "os"
+import "os/signal"
+import "sort"
+import "strconv"
+import "strings"
+import "sync"
+import "sync/atomic"
+import "syscall"
+import "time"
 
 const MAXBYTES = 1000
 
+var OUTPUT io.Writer = os.Stdout
+
+// Operational errors, such as bad options or failures to listen, store or respond.  The
+// same as OUTPUT unless -json-logs-to-stderr sends them to stderr.
+var ERRORS io.Writer = os.Stdout
+var ERRORSTOSTDERR bool
+
+// Where errors found while handling a request go: output, usually the request's block, or
+// ERRORS under -json-logs-to-stderr.
+func requestErrors(output io.Writer) io.Writer {
+	if ERRORSTOSTDERR {
+		return ERRORS
+	}
+
+	return output
+}
+
 var RAW bool
+var VERBOSE bool
+var STRICT bool
+var DECODEERRORSFATAL bool
 
-func display(writer http.ResponseWriter, request *http.Request) {
-	fmt.Printf("######\n")
-	fmt.Printf("# %s request to %s\n", request.Method, request.URL)
+// Closed on the first request with errors under -decode-errors-fatal, to shut down.
+var decodeFailed = make(chan struct{})
+var decodeFailedOnce sync.Once
+var MAXRATIO int
+var RAWBODY string
+var REDIRECT string
+var REDIRECTSTATUS int
+var TLSCERT string
+var TLSKEY string
+var TLSMINVERSION string
 
-	userAgent, ok := request.Header["User-Agent"]
-	if ok {
-		fmt.Printf("# from %s\n", userAgent)
+var TLSVERSIONS = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+var CLIENTCA string
+var REJECTEMPTY bool
+var DATAFILEJSON bool
+var PRETTYDATAFILE bool
+var SAMPLE bool
+var NOKEEPALIVE bool
+var KEEPALIVETIMEOUT time.Duration
+var MAXHEADERBYTES int
+var BASE64DEPTH int
+var MAXJSONDEPTH int
+var TRAILERFORMAT string
+var REQUESTTIMEOUT time.Duration
+
+// A repeatable string flag.
+type stringList []string
+
+func (list *stringList) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *stringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+var ADDRS stringList
+var PORT int
+var NETWORK string
+
+var ErrRatio = errors.New("gzip data exceeds the maximum compression ratio")
+var ErrChecksum = errors.New("gzip checksum mismatch")
+
+// Header values that are never printed.
+var SENSITIVE = map[string]bool{
+	"Authorization":       true,
+	"Cookie":              true,
+	"Proxy-Authorization": true,
+	"Set-Cookie":          true,
+}
+
+func redact(header map[string][]string) map[string][]string {
+	redacted := make(map[string][]string, len(header))
+
+	for key, values := range header {
+		if SENSITIVE[key] {
+			values = []string{"[redacted]"}
+		}
+
+		redacted[key] = values
 	}
 
-	contentType, ok := request.Header["Content-Type"]
-	if ok {
-		fmt.Printf("# %s\n", contentType)
+	return redacted
+}
+
+func printHeaders(output io.Writer, header map[string][]string) {
+	header = redact(header)
+
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
 	}
+	sort.Strings(keys)
 
-	contentLength, ok := request.Header["Content-Length"]
-	if ok {
-		fmt.Printf("# %s bytes\n", contentLength)
+	for _, key := range keys {
+		for _, value := range header[key] {
+			fmt.Fprintf(output, "#\t%s: %s\n", key, value)
+		}
+	}
+}
+
+func respondError(writer http.ResponseWriter, status int, message string) {
+	body, _ := json.Marshal(map[string]string{"success": "false", "error": message})
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	writeLine(writer, body)
+}
+
+func truncate(output io.Writer, data []byte) []byte {
+	if len(data) > MAXBYTES {
+		fmt.Fprintf(output, "# Note: cut output to %d bytes\n", MAXBYTES)
+		return data[0:MAXBYTES]
 	}
 
-	err := request.ParseForm()
+	return data
+}
+
+func decompress(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
 	if err != nil {
-		fmt.Printf("# form: %+v\n", request.Form)
+		return nil, fmt.Errorf("opening gzipped data: %s", err)
 	}
 
-	err = request.ParseMultipartForm(50)
-	if err == nil {
-		if len(request.MultipartForm.File) != 0 {
-			fmt.Printf("# multipart files:\n")
+	var source io.Reader = reader
+	if MAXRATIO > 0 {
+		source = io.LimitReader(reader, int64(MAXRATIO*len(data))+1)
+	}
+
+	// Reading through to EOF is what makes gzip check the trailing CRC-32 and size.
+	uncompressed, err := ioutil.ReadAll(source)
+	if errors.Is(err, gzip.ErrChecksum) {
+		return nil, ErrChecksum
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("reading gzipped data: %s", err)
+	}
+
+	if MAXRATIO > 0 && len(uncompressed) > MAXRATIO*len(data) {
+		return nil, ErrRatio
+	}
+
+	return uncompressed, nil
+}
+
+// Remove ASCII whitespace, such as the line breaks between concatenated or MIME wrapped
+// base64 chunks.
+func stripSpace(value string) string {
+	return strings.Map(func(char rune) rune {
+		switch char {
+		case ' ', '\t', '\n', '\r', '\v', '\f':
+			return -1
+		}
+
+		return char
+	}, value)
+}
+
+// Decode whitespace separated base64 chunks that were each padded separately.
+func decodeChunks(encoded string) ([]byte, error) {
+	var decoded []byte
+
+	for _, chunk := range strings.Fields(encoded) {
+		data, err := base64.StdEncoding.DecodeString(chunk)
+		if err != nil {
+			return nil, err
 		}
 
-		for file, handles := range request.MultipartForm.File {
-			for _, handle := range handles {
-				fmt.Printf("# %s: %d bytes\n", handle.Filename, handle.Size)
+		decoded = append(decoded, data...)
+	}
+
+	return decoded, nil
+}
+
+// Log an error from decompress, returning the reason to reject the request under -strict,
+// if any.
+func logDecompressError(err error, entry *RequestEntry) string {
+	if err == ErrChecksum {
+		fmt.Fprintf(&entry.output, "# %s\n", err)
+		entry.Errors = append(entry.Errors, err.Error())
+		return err.Error()
+	}
+
+	entry.logError("%s", err)
+	if err == ErrRatio {
+		return err.Error()
+	}
+
+	return ""
+}
+
+// Decompress only the first MAXBYTES of a gzip stream, counting the rest without keeping
+// it.  Returns the sample, the total decompressed size and the gzip header's metadata.
+func sampleGzip(compressed *countingReader) ([]byte, int64, *GzipHeader, error) {
+	reader, err := gzip.NewReader(compressed)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("opening gzipped data: %s", err)
+	}
+
+	var source io.Reader = reader
+	if MAXRATIO > 0 {
+		source = &ratioReader{Reader: reader, compressed: compressed}
+	}
+
+	sample, err := ioutil.ReadAll(io.LimitReader(source, MAXBYTES))
+
+	var rest int64
+	if err == nil {
+		rest, err = io.Copy(ioutil.Discard, source)
+	}
+
+	if err == ErrRatio {
+		return nil, 0, nil, err
+	}
+
+	if errors.Is(err, gzip.ErrChecksum) {
+		return nil, 0, nil, ErrChecksum
+	}
+
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("reading gzipped data: %s", err)
+	}
+
+	return sample, int64(len(sample)) + rest, gzipMetadata(reader.Header), nil
+}
+
+// The metadata a gzip header carries, nil if it has none.
+func gzipMetadata(header gzip.Header) *GzipHeader {
+	metadata := &GzipHeader{Name: header.Name, Comment: header.Comment}
+	if !header.ModTime.IsZero() {
+		modTime := header.ModTime.UTC()
+		metadata.ModTime = &modTime
+	}
+
+	if metadata.Name == "" && metadata.Comment == "" && metadata.ModTime == nil {
+		return nil
+	}
+
+	return metadata
+}
+
+// The metadata in the header of gzipped data, nil if it has none or can't be read.
+func readGzipHeader(data []byte) *GzipHeader {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil
+	}
+
+	return gzipMetadata(reader.Header)
+}
+
+func showGzipHeader(output io.Writer, metadata *GzipHeader) {
+	if metadata == nil {
+		return
+	}
 
-				reader, err := handle.Open()
-				if err != nil {
-					fmt.Printf("# Error opening file: %s\n", err)
-					continue
-				}
+	if metadata.Name != "" {
+		fmt.Fprintf(output, "# gzip name: %s\n", metadata.Name)
+	}
+
+	if metadata.Comment != "" {
+		fmt.Fprintf(output, "# gzip comment: %s\n", metadata.Comment)
+	}
+
+	if metadata.ModTime != nil {
+		fmt.Fprintf(output, "# gzip modified: %s\n", metadata.ModTime.Format(time.RFC3339))
+	}
+}
+
+// Fails with ErrRatio once more than MAXRATIO times the compressed bytes read so far have
+// been decompressed.
+type ratioReader struct {
+	io.Reader
+	compressed *countingReader
+	total      int64
+}
+
+func (reader *ratioReader) Read(buffer []byte) (int, error) {
+	read, err := reader.Reader.Read(buffer)
+	reader.total += int64(read)
+
+	if reader.total > int64(MAXRATIO)*reader.compressed.count {
+		return read, ErrRatio
+	}
+
+	return read, err
+}
+
+func decodeData(element map[string]string, entry *RequestEntry) {
+	encoded, exists := element["data"]
+	if !exists {
+		return
+	}
+
+	decoded, err := runPipeline([]byte(encoded), entry)
+	if err != nil {
+		entry.logError("%s", err)
+		return
+	}
 
-				data, err := ioutil.ReadAll(reader)
-				if err != nil {
-					fmt.Printf("# Error reading file: %s\n", err)
-				}
+	element["data"] = string(truncate(&entry.output, decoded))
+}
 
-				if !RAW && file == "dataFile" {
-					reader, err := gzip.NewReader(bytes.NewReader(data))
-					if err != nil {
-						fmt.Printf("# Error opening gzipped data: %s\n", err)
-						continue
-					}
+func mediaType(request *http.Request) string {
+	mediaType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
 
-					uncompressed, err := ioutil.ReadAll(reader)
-					if err != nil {
-						fmt.Printf("# Error reading gzipped data: %s\n", err)
-						continue
-					}
+	return mediaType
+}
 
-					fmt.Printf("# Decoded gzip data\n")
+// How deeply the json value in data nests, stopping once it passes limit.
+func jsonDepth(data []byte, limit int) (int, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
 
-					if len(uncompressed) > MAXBYTES {
-						fmt.Printf("# Note: cut output to %d bytes\n", MAXBYTES)
-						uncompressed = uncompressed[0:MAXBYTES]
-					}
+	depth, deepest := 0, 0
+	for deepest <= limit {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
 
-					data = uncompressed
-				}
+		if err != nil {
+			return deepest, err
+		}
 
-				fmt.Printf("#\t%s:\n%s\n", file, data)
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+			if depth > deepest {
+				deepest = depth
 			}
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+
+	return deepest, nil
+}
+
+// Undo percent-encoding of json values, as sent by clients that URL-encode item fields.
+// Json itself can't start with a '%', so other values are left alone.
+func unescapeJSON(value string) (string, bool) {
+	if !strings.HasPrefix(value, "%7B") && !strings.HasPrefix(value, "%7b") &&
+		!strings.HasPrefix(value, "%5B") && !strings.HasPrefix(value, "%5b") {
+		return value, false
+	}
+
+	unescaped, err := url.QueryUnescape(value)
+	if err != nil {
+		return value, false
+	}
+
+	return unescaped, true
+}
+
+// Decode a json value holding either one object or an array of them, as older and newer
+// clients send items respectively.
+func unmarshalItems(data []byte) ([]map[string]string, error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var elements []map[string]string
+		err := json.Unmarshal(trimmed, &elements)
+		if err != nil {
+			return nil, err
 		}
 
-		if len(request.MultipartForm.Value) != 0 {
-			fmt.Printf("# multipart values:\n")
+		var items []map[string]string
+		for _, element := range elements {
+			if element != nil {
+				items = append(items, element)
+			}
 		}
 
-		for key, value := range request.MultipartForm.Value {
-			var jsonValue []map[string]string
+		return items, nil
+	}
 
-			for _, element := range value {
-				var jsonData map[string]string
+	var item map[string]string
+	err := json.Unmarshal(data, &item)
+	if err != nil || item == nil {
+		return nil, err
+	}
 
-				err := json.Unmarshal([]byte(element), &jsonData)
-				if err != nil {
-					fmt.Printf("# Error decoding json: %s\n", err)
-					continue
-				}
+	return []map[string]string{item}, nil
+}
+
+// Print form or multipart values, decoding 'item' json and base64 'data'.
+func displayValues(values map[string][]string, entry *RequestEntry) {
+	for key, value := range values {
+		if !RAW && key == "data" {
+			var decodedValue []string
+
+			for _, element := range value {
+				decoded := map[string]string{"data": element}
+				decodeData(decoded, entry)
+				redactItem(key, decoded)
 
-				jsonValue = append(jsonValue, jsonData)
+				decodedValue = append(decodedValue, decoded["data"])
 			}
 
-			if !RAW && key == "item" {
-				for _, element := range jsonValue {
-					encoded, exists := element["data"]
+			fmt.Fprintf(&entry.output, "#\t%s:\n", key)
+			for _, element := range decodedValue {
+				fmt.Fprintf(&entry.output, "#\t\t%s\n", element)
+				entry.Values[key] = append(entry.Values[key], map[string]string{"data": element})
+			}
+			continue
+		}
 
-					if exists {
-						decoded, err := base64.StdEncoding.DecodeString(encoded)
-						if err != nil {
-							fmt.Printf("# Error decoding base64 data: %s\n", err)
-							continue
-						}
+		var jsonValue []map[string]string
 
-						fmt.Printf("# Decoded base64 data\n")
+		for _, element := range value {
+			if unescaped, ok := unescapeJSON(element); ok {
+				fmt.Fprintf(&entry.output, "# URL-decoded %s value\n", key)
+				element = unescaped
+			}
 
-						if len(decoded) > MAXBYTES {
-							fmt.Printf("# Note: cut output to %d bytes\n", MAXBYTES)
-							decoded = decoded[0:MAXBYTES]
-						}
+			if depth, err := jsonDepth([]byte(element), MAXJSONDEPTH); err == nil && depth > MAXJSONDEPTH {
+				entry.logError("%s json nests deeper than %d levels", key, MAXJSONDEPTH)
+				continue
+			}
 
-						element["data"] = string(decoded)
-					}
-				}
+			start := time.Now()
+			jsonData, err := unmarshalItems([]byte(element))
+			entry.timeStage("json", start)
+			if err != nil {
+				entry.logError("decoding json: %s", err)
+				continue
 			}
 
-			fmt.Printf("#\t%s:\n", key)
+			jsonValue = append(jsonValue, jsonData...)
+		}
+
+		if !RAW && key == "item" {
 			for _, element := range jsonValue {
-				for jkey, jvalue := range element {
-					fmt.Printf("#\t\t%s: %s\n", jkey, jvalue)
-				}
+				decodeData(element, entry)
 			}
 		}
 
-	} else {
-		fmt.Printf("# multipart error: %s\n", err)
+		for _, element := range jsonValue {
+			redactItem(key, element)
+		}
+
+		entry.Values[key] = append(entry.Values[key], jsonValue...)
+
+		fmt.Fprintf(&entry.output, "#\t%s:\n", key)
+		for _, element := range jsonValue {
+			for jkey, jvalue := range element {
+				fmt.Fprintf(&entry.output, "#\t\t%s: %s\n", jkey, jvalue)
+			}
+		}
 	}
+}
 
-	body, err := ioutil.ReadAll(request.Body)
+// Gunzip a dataFile for display.  Returns what to show and the whole decompressed data,
+// both nil if it couldn't be decoded, and the reason to reject the request under -strict,
+// if any.
+func decodeDataFile(data []byte, entry *RequestEntry) ([]byte, []byte, string) {
+	start := time.Now()
+	uncompressed, err := decompress(data)
+	entry.timeStage("gzip", start)
+	if err != nil {
+		return nil, nil, logDecompressError(err, entry)
+	}
 
-	if len(body) > 0 {
-		fmt.Printf("# body: %s\n", body)
+	fmt.Fprintf(&entry.output, "# Decoded gzip data\n")
+
+	entry.DataFileBytes += len(uncompressed)
+	entry.keepDecoded("dataFile", uncompressed)
+
+	if entry.echoRequested {
+		entry.echo = append(entry.echo, uncompressed...)
+	}
+
+	shown := uncompressed
+
+	var reason string
+	if protoType != nil {
+		start := time.Now()
+		decoded, err := protoToJSON(uncompressed)
+		entry.timeStage("json", start)
+		if err != nil {
+			entry.logError("dataFile is not a valid %s: %s", PROTOMESSAGE, err)
+			reason = "dataFile is not valid protobuf"
+		} else {
+			fmt.Fprintf(&entry.output, "# Decoded %s protobuf\n", PROTOMESSAGE)
+			shown = decoded
+		}
+	} else if DATAFILEJSON {
+		start := time.Now()
+		err := json.Unmarshal(uncompressed, new(json.RawMessage))
+		entry.timeStage("json", start)
+		if err != nil {
+			entry.logError("dataFile is not valid json: %s", err)
+			reason = "dataFile is not valid json"
+		} else if PRETTYDATAFILE {
+			var pretty bytes.Buffer
+			json.Indent(&pretty, uncompressed, "", "  ")
+			shown = pretty.Bytes()
+		}
+	} else if DATAFILEFORMAT == "csv" || (DATAFILEFORMAT == "auto" && looksLikeCSV(uncompressed)) {
+		rows := displayCSV(uncompressed, entry)
+		if rows == nil {
+			reason = "dataFile is not valid csv"
+		} else {
+			shown = rows
+		}
+	}
+
+	return truncate(&entry.output, redactBody("dataFile", shown)), uncompressed, reason
+}
+
+// Decode a whole request body as a single payload, returning the reason to reject it
+// under -strict, if any.
+func displayPayload(body []byte, entry *RequestEntry) string {
+	if RAW {
+		entry.Body = string(transcodeBody(entry, truncate(&entry.output, redactBody("body", body))))
+		fmt.Fprintf(&entry.output, "# body: %s\n", entry.Body)
+		return ""
+	}
+
+	if len(body) > 1 && body[0] == 0x1f && body[1] == 0x8b {
+		start := time.Now()
+		uncompressed, err := decompress(body)
+		entry.timeStage("gzip", start)
+		if err != nil {
+			return logDecompressError(err, entry)
+		}
+
+		fmt.Fprintf(&entry.output, "# Decoded gzip data\n")
+		body = uncompressed
 	}
 
-	fmt.Printf("######\n\n\n")
+	var jsonData map[string]string
 
+	start := time.Now()
+	err := json.Unmarshal(body, &jsonData)
+	entry.timeStage("json", start)
 	if err != nil {
-		fmt.Printf("Error reading body: %s\n", err)
+		body = redactBody("body", body)
+		entry.keepDecoded("body", body)
+		entry.Body = string(transcodeBody(entry, truncate(&entry.output, body)))
+		fmt.Fprintf(&entry.output, "# body: %s\n", entry.Body)
+		return ""
+	}
+
+	decodeData(jsonData, entry)
+	redactItem("body", jsonData)
+	entry.Values["body"] = append(entry.Values["body"], jsonData)
+
+	fmt.Fprintf(&entry.output, "#\tbody:\n")
+	for jkey, jvalue := range jsonData {
+		fmt.Fprintf(&entry.output, "#\t\t%s: %s\n", jkey, jvalue)
 	}
 
-	fmt.Fprintf(writer, "{\"success\":\"true\"}")
+	return ""
 }
 
-func main() {
-	flag.BoolVar(&RAW, "raw", false, "whether or not to interpret data")
-	flag.Parse()
+// Show the body bytes left over by form and multipart parsing as -trailer-format says.
+func displayTrailer(body []byte, entry *RequestEntry) {
+	if TRAILERFORMAT != "ignore" {
+		body = redactBody("body", body)
+	}
+
+	switch TRAILERFORMAT {
+	case "hex":
+		entry.Trailer = hex.EncodeToString(body)
+	case "base64":
+		entry.Trailer = base64.StdEncoding.EncodeToString(body)
+	case "ignore":
+		fmt.Fprintf(&entry.output, "# ignored %d trailing bytes\n", len(body))
+		return
+	default:
+		entry.Body = string(transcodeBody(entry, body))
+		fmt.Fprintf(&entry.output, "# body: %s\n", entry.Body)
+		return
+	}
+
+	fmt.Fprintf(&entry.output, "# trailer (%s, %d bytes): %s\n", TRAILERFORMAT, len(body), entry.Trailer)
+}
+
+// Counts the bytes read through it and the time spent reading, keeping the first error
+// other than io.EOF.
+type countingReader struct {
+	io.ReadCloser
+	count   int64
+	elapsed time.Duration
+	err     error
+}
+
+func (reader *countingReader) Read(buffer []byte) (int, error) {
+	start := time.Now()
+	read, err := reader.ReadCloser.Read(buffer)
+	reader.elapsed += time.Since(start)
+	reader.count += int64(read)
+
+	if err != nil && err != io.EOF && reader.err == nil {
+		reader.err = err
+	}
+
+	return read, err
+}
+
+// Returns whether the request has no body, peeking into it when the length isn't known.
+func emptyBody(request *http.Request) bool {
+	if request.ContentLength != -1 {
+		return request.ContentLength == 0
+	}
+
+	reader := bufio.NewReader(request.Body)
+	_, err := reader.Peek(1)
+	request.Body = struct {
+		io.Reader
+		io.Closer
+	}{reader, request.Body}
+
+	return err == io.EOF
+}
 
-	http.HandleFunc("/datastore", display)
+// Add the request's body to its -resumable upload.  When the upload is now complete the
+// request body is replaced by the whole upload to be processed as usual; otherwise the
+// response has been written.
+func resumeUpload(writer http.ResponseWriter, request *http.Request, entry *RequestEntry) bool {
+	id := request.Header.Get(UPLOADIDHEADER)
+	if id == "" {
+		entry.logError("missing %s header", UPLOADIDHEADER)
+		respondError(writer, http.StatusBadRequest, "missing "+UPLOADIDHEADER+" header")
+		return false
+	}
+
+	chunk, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		entry.logError("reading chunk: %s", err)
+		respondError(writer, http.StatusBadRequest, "error reading chunk")
+		return false
+	}
 
-	err := http.ListenAndServe(":8000", nil)
+	received, data, err := addChunk(id, *entry.Range, chunk)
 	if err != nil {
-		fmt.Printf("Error serving: %s\n", err)
+		entry.logError("upload %s: %s", id, err)
+		respondError(writer, http.StatusBadRequest, err.Error())
+		return false
+	}
+
+	if data == nil {
+		fmt.Fprintf(&entry.output, "# upload %s: %d bytes received\n", id, received)
+
+		if received > 0 {
+			writer.Header().Set("Range", fmt.Sprintf("bytes=0-%d", received-1))
+		}
+		writer.WriteHeader(http.StatusPermanentRedirect)
+		return false
+	}
+
+	fmt.Fprintf(&entry.output, "# upload %s: complete at %d bytes\n", id, received)
+
+	request.Body = ioutil.NopCloser(bytes.NewReader(data))
+	request.ContentLength = int64(len(data))
+
+	return true
+}
+
+// IPv4, IPv6, or dual-stack for a tcp listener on the unspecified IPv6 address.
+func addressFamily(addr net.Addr) string {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return addr.Network()
+	}
+
+	if tcp.IP.To4() != nil {
+		return "IPv4"
+	}
+
+	if tcp.IP.IsUnspecified() && NETWORK == "tcp" {
+		return "dual-stack"
+	}
+
+	return "IPv6"
+}
+
+// Count a finished request, and pass it on to the history, -manifest and /live.
+func finishRequest(entry *RequestEntry, bytesRead int64) {
+	countRequest(entry, bytesRead)
+
+	if MANIFESTFILE != "" {
+		checkManifest(entry)
+	}
+
+	if HISTORY > 0 && !VALIDATEONLY {
+		remember(entry)
+	}
+
+	publish(entry)
+}
+
+func display(writer http.ResponseWriter, request *http.Request) {
+	if slots != nil {
+		if !acquireSlot(request.Context()) {
+			fmt.Fprintf(OUTPUT, "# %s request to %s from %s got no slot, answered with a 503\n\n",
+				request.Method, request.URL.Path, clientIP(request))
+
+			respondError(writer, http.StatusServiceUnavailable, "too many concurrent requests")
+			return
+		}
+		defer releaseSlot()
+	}
+
+	atomic.AddInt64(&inFlight, 1)
+	defer atomic.AddInt64(&inFlight, -1)
+
+	// Set when the request should be refused under -strict.
+	var rejection string
+
+	// Set once the request is far enough along for -on-request, which runs after the
+	// response so the entry has its status and headers.
+	var runOnRequest bool
+
+	if len(responseHeaders) != 0 {
+		writer = &headerWriter{ResponseWriter: writer}
+	}
+
+	if REFLECTHEADERS != "" {
+		reflectHeaders(writer, request)
+	}
+
+	entry := newRequestEntry()
+	start := entry.Time
+	entry.Method = request.Method
+	entry.URL = request.URL.String()
+	entry.Host = request.Host
+	entry.Proto = request.Proto
+	entry.Header = redact(request.Header)
+	entry.Client = clientIP(request)
+	entry.ContentLength = request.ContentLength
+
+	entry.echoRequested = request.URL.Query().Get("echo") == "true"
+
+	// Deferred first so it runs last, once the gzip writer has finished the response.
+	var finished bool
+	defer func() {
+		if finished {
+			requestFinished(request, entry)
+		}
+	}()
+
+	if GZIPRESPONSES && acceptsGzip(request) {
+		compressor := &gzipResponseWriter{ResponseWriter: writer}
+		writer = compressor
+		defer compressor.Close()
+	}
+
+	recorder := &statusRecorder{ResponseWriter: writer, ctx: request.Context()}
+	writer = recorder
+
+	// -validate-only requests are only checked, never stored or kept in the history.
+	if teeRawBody() && !VALIDATEONLY {
+		capture := captureBody(request, entry)
+		if capture != nil {
+			defer capture.Close()
+		}
+	}
+
+	if READDELAY > 0 {
+		request.Body = &slowReader{ReadCloser: request.Body, ctx: request.Context()}
+	}
+
+	counter := &countingReader{ReadCloser: request.Body}
+	request.Body = counter
+
+	defer func() {
+		entry.flushOutput()
+
+		entry.Status = recorder.status
+		entry.ResponseHeader = redact(recorder.Header())
+
+		finishRequest(entry, counter.count)
+		finished = true
+
+		if runOnRequest {
+			go runHook(entry)
+		}
+	}()
+
+	fmt.Fprintf(&entry.output, "######\n")
+	fmt.Fprintf(&entry.output, "# %s request to %s\n", request.Method, request.URL)
+	fmt.Fprintf(&entry.output, "# client %s\n", entry.Client)
+	fmt.Fprintf(&entry.output, "# protocol %s\n", entry.Proto)
+
+	fmt.Fprintf(&entry.output, "# seq %d\n", entry.Seq)
+
+	userAgent, ok := request.Header["User-Agent"]
+	if ok {
+		fmt.Fprintf(&entry.output, "# from %s\n", userAgent)
+	}
+
+	contentType, ok := request.Header["Content-Type"]
+	if ok {
+		fmt.Fprintf(&entry.output, "# %s\n", contentType)
+	}
+
+	contentLength, ok := request.Header["Content-Length"]
+	if ok {
+		fmt.Fprintf(&entry.output, "# %s bytes\n", contentLength)
+	}
+
+	if VERBOSE && request.TLS != nil {
+		fmt.Fprintf(&entry.output, "# %s, %s\n", tls.VersionName(request.TLS.Version), tls.CipherSuiteName(request.TLS.CipherSuite))
+	}
+
+	if DECODEJWT && request.Header.Get("Authorization") != "" {
+		displayJWT(&entry.output, request.Header.Get("Authorization"))
+	}
+
+	if CLIENTCA != "" {
+		if request.TLS == nil || len(request.TLS.VerifiedChains) == 0 {
+			fmt.Fprintf(&entry.output, "# no verified client certificate\n")
+			fmt.Fprintf(&entry.output, "######\n\n\n")
+
+			respondError(writer, http.StatusForbidden, "client certificate required")
+			return
+		}
+
+		cert := request.TLS.PeerCertificates[0]
+		entry.CertSubject = cert.Subject.String()
+		entry.CertSerial = cert.SerialNumber.String()
+		fmt.Fprintf(&entry.output, "# client cert: CN=%s serial=%s\n", cert.Subject.CommonName, cert.SerialNumber)
+	}
+
+	if REDIRECT != "" {
+		fmt.Fprintf(&entry.output, "# redirected to %s (%d)\n", REDIRECT, REDIRECTSTATUS)
+		fmt.Fprintf(&entry.output, "######\n\n\n")
+
+		http.Redirect(writer, request, REDIRECT, REDIRECTSTATUS)
+		return
+	}
+
+	if REJECTEMPTY && emptyBody(request) {
+		fmt.Fprintf(&entry.output, "# rejected empty body\n")
+		fmt.Fprintf(&entry.output, "######\n\n\n")
+
+		respondError(writer, http.StatusBadRequest, "request body is empty")
+		return
+	}
+
+	rangeHeader := request.Header.Get("Content-Range")
+	if rangeHeader != "" {
+		contentRange, err := parseContentRange(rangeHeader)
+		if err != nil {
+			entry.logError("parsing Content-Range: %s", err)
+		} else {
+			entry.Range = &contentRange
+			fmt.Fprintf(&entry.output, "# range %s\n", contentRange)
+		}
+
+		if RESUMABLE && entry.Range != nil {
+			complete := resumeUpload(writer, request, entry)
+			if !complete {
+				fmt.Fprintf(&entry.output, "######\n\n\n")
+				return
+			}
+		}
+	}
+
+	// The body is consumed while decoding, so keep a copy for anything needing it whole.
+	// -sample stores the body through a tee instead.
+	var bodyCopy []byte
+	if FORWARD != "" || HMACSECRET != "" || (STOREDIR != "" && !SAMPLE) || REJECTDUPLICATES {
+		data, err := ioutil.ReadAll(request.Body)
+		if err != nil {
+			entry.logError("reading body: %s", err)
+		}
+
+		bodyCopy = data
+		request.Body = ioutil.NopCloser(bytes.NewReader(bodyCopy))
+	}
+
+	signatureFailed := false
+	if HMACSECRET != "" {
+		signatureFailed = !verifySignature(&entry.output, bodyCopy, request.Header.Get(HMACHEADER))
+	}
+
+	// A body without a Content-Type is sniffed, and decoded as a single payload unless it
+	// looks like a form or multipart body.
+	var sniffed string
+	if request.Header.Get("Content-Type") == "" {
+		sniffed = sniffContentType(request)
+		if sniffed != "" {
+			fmt.Fprintf(&entry.output, "# WARNING: no Content-Type header, sniffed %s\n", sniffed)
+		}
+	}
+
+	contentMedia := mediaType(request)
+	rawBody := RAWBODY == "true" || (RAWBODY == "auto" && contentMedia != "multipart/form-data") ||
+		(sniffed != "" && contentMedia == "")
+
+	if !rawBody {
+		problem := boundaryProblem(request.Header.Get("Content-Type"))
+		if problem != "" {
+			entry.logError("%s", problem)
+			fmt.Fprintf(&entry.output, "######\n\n\n")
+
+			respondError(writer, http.StatusBadRequest, problem)
+			return
+		}
+	}
+
+	// Parsing reads the body and decodes values as it goes, which are timed separately.
+	parseStart := time.Now()
+	parseExcluded := counter.elapsed + entry.decodeTime()
+
+	if !rawBody && contentMedia == "application/x-www-form-urlencoded" {
+		err := request.ParseForm()
+		if err != nil {
+			fmt.Fprintf(&entry.output, "# form error: %s\n", err)
+		} else if len(request.PostForm) != 0 {
+			fmt.Fprintf(&entry.output, "# form values:\n")
+			displayValues(request.PostForm, entry)
+		}
+	} else if !rawBody {
+		reader, err := request.MultipartReader()
+		if err == nil {
+			reason := displayMultipart(reader, entry)
+			if reason != "" {
+				rejection = reason
+			}
+
+			for _, field := range missingFields(entry) {
+				fmt.Fprintf(&entry.output, "# MISSING required field: %s\n", field)
+				entry.Errors = append(entry.Errors, "missing required field "+field)
+				rejection = "missing required field " + field
+			}
+		} else if errors.Is(err, http.ErrNotMultipart) {
+			if VERBOSE {
+				fmt.Fprintf(&entry.output, "# not a multipart request\n")
+			}
+		} else {
+			entry.logError("parsing multipart form: %s", err)
+		}
+	}
+
+	entry.addStage("parse", time.Since(parseStart)-(counter.elapsed+entry.decodeTime()-parseExcluded))
+
+	body, err := ioutil.ReadAll(request.Body)
+
+	if len(body) > 0 {
+		if rawBody {
+			reason := displayPayload(body, entry)
+			if reason != "" {
+				rejection = reason
+			}
+		} else {
+			displayTrailer(body, entry)
+		}
+	}
+
+	entry.BytesRead = counter.count
+	if entry.ContentLength >= 0 && entry.BytesRead != entry.ContentLength {
+		fmt.Fprintf(&entry.output, "# WARNING: Content-Length=%d but read %d bytes\n",
+			entry.ContentLength, entry.BytesRead)
+	}
+
+	var problems []string
+	if VALIDATEONLY {
+		problems = validate(request, entry)
+		printValidation(&entry.output, problems)
+	}
+
+	elapsed := time.Since(start)
+	entry.DurationMS = float64(elapsed) / float64(time.Millisecond)
+	fmt.Fprintf(&entry.output, "# processed in %s\n", elapsed.Round(time.Microsecond))
+
+	entry.addStage("read", counter.elapsed)
+	if VERBOSE {
+		fmt.Fprintf(&entry.output, "# timing: %s\n", entry.formatTiming())
+	}
+
+	storeError := false
+	if STOREDIR != "" && !VALIDATEONLY {
+		storeError = !storeRequest(entry, bodyCopy)
+	}
+
+	var mockStatus int
+	if ALLOWSTATUSHEADER {
+		mockStatus = requestedStatus(request, entry)
+	}
+
+	var original int64
+	if REJECTDUPLICATES {
+		original = duplicateOf(entry, bodyCopy, request.Header.Get("Content-Type"))
+		if original != 0 {
+			fmt.Fprintf(&entry.output, "# duplicate of request %d\n", original)
+		}
+	}
+
+	var fixture *fixedResponse
+	if RESPONSES != nil {
+		var value string
+		fixture, value = matchResponse(entry)
+		if fixture != nil {
+			fmt.Fprintf(&entry.output, "# matched canned response for %s=%s\n", RESPONSEKEY, value)
+		}
+	}
+
+	if fixture == nil && PATHRESPONSES != nil {
+		var prefix string
+		fixture, prefix = matchPathResponse(entry, request.URL.Path)
+		if fixture != nil {
+			fmt.Fprintf(&entry.output, "# matched response for path prefix %s\n", prefix)
+		}
+	}
+
+	var delay time.Duration
+	if name := request.Header.Get(SCENARIOHEADER); SCENARIOS != nil && name != "" {
+		outcome, found := SCENARIOS[name]
+		if found {
+			fmt.Fprintf(&entry.output, "# scenario %s\n", name)
+			fixture = &outcome.fixedResponse
+			delay = outcome.delay
+		} else {
+			fmt.Fprintf(&entry.output, "# unknown scenario %s, answering as usual\n", name)
+		}
+	}
+
+	if DELAY.kind != "" {
+		delay += DELAY.sample()
+		fmt.Fprintf(&entry.output, "# delaying response by %s\n", delay.Round(time.Millisecond))
+	}
+
+	if DELAYPERMB > 0 && entry.DataFileBytes > 0 {
+		extra := sizeDelay(entry.DataFileBytes)
+		delay += extra
+		fmt.Fprintf(&entry.output, "# delaying response by %s for %s of data\n",
+			extra.Round(time.Millisecond), formatBytes(int64(entry.DataFileBytes)))
+	}
+
+	faultStatus, faultDelay := injectFault()
+	if faultDelay > 0 {
+		delay += faultDelay
+		fmt.Fprintf(&entry.output, "# delaying response by %s for fault injection\n", faultDelay.Round(time.Millisecond))
+	}
+
+	if faultStatus != 0 {
+		fmt.Fprintf(&entry.output, "# injecting fault: status %d\n", faultStatus)
+	}
+
+	abort := shouldAbort()
+	if abort {
+		fmt.Fprintf(&entry.output, "# aborting: the connection will be closed mid-response\n")
+	}
+
+	var upstream *http.Response
+	if FORWARD != "" && !VALIDATEONLY && !(STRICT && (rejection != "" || signatureFailed)) {
+		upstream = forward(&entry.output, request, bodyCopy)
+		if upstream != nil {
+			defer upstream.Body.Close()
+		}
+	}
+
+	fmt.Fprintf(&entry.output, "######\n\n\n")
+	entry.flushOutput()
+
+	if err != nil {
+		fmt.Fprintf(ERRORS, "Error reading body: %s\n", err)
+	}
+
+	if VALIDATEONLY {
+		respondValidation(writer, problems)
+		return
+	}
+
+	runOnRequest = runsHook()
+
+	if delay > 0 && !sleepContext(request.Context(), delay) {
+		if errors.Is(request.Context().Err(), context.DeadlineExceeded) {
+			fmt.Fprintf(&entry.output, "# -request-timeout passed during the %s delay\n", delay.Round(time.Millisecond))
+		} else {
+			fmt.Fprintf(&entry.output, "# client went away during the %s delay\n", delay.Round(time.Millisecond))
+		}
+		return
+	}
+
+	writer.Header().Set("X-Items-Received", strconv.Itoa(entry.ItemCount()))
+	writer.Header().Set("X-DataFile-Bytes", strconv.Itoa(entry.DataFileBytes))
+
+	if STRICT && signatureFailed {
+		respondError(writer, http.StatusUnauthorized, "invalid signature")
+		return
+	}
+
+	if STRICT && rejection != "" {
+		respondError(writer, http.StatusBadRequest, rejection)
+		return
+	}
+
+	if DECODEERRORSFATAL && len(entry.Errors) != 0 {
+		respondError(writer, http.StatusBadRequest, entry.Errors[0])
+
+		decodeFailedOnce.Do(func() {
+			fmt.Fprintf(ERRORS, "# exiting: request %d could not be decoded: %s\n", entry.Seq, entry.Errors[0])
+			close(decodeFailed)
+		})
+		return
+	}
+
+	if STOREREQUIRED && storeError {
+		respondError(writer, http.StatusInternalServerError, "could not store request")
+		return
+	}
+
+	if original != 0 {
+		respondDuplicate(writer, original)
+		return
+	}
+
+	if mockStatus != 0 {
+		writeStatus(writer, mockStatus, entry)
+		return
+	}
+
+	if faultStatus != 0 {
+		respondError(writer, faultStatus, "injected fault")
+		return
+	}
+
+	if abort {
+		abortResponse(writer)
+		return
+	}
+
+	if FORWARD != "" {
+		relay(writer, upstream)
+		return
+	}
+
+	if fixture != nil {
+		writeFixedResponse(writer, fixture)
+		return
+	}
+
+	if MIRROR && writeMirror(writer, entry) {
+		return
+	}
+
+	if entry.echoRequested && writeEcho(writer, entry) {
+		return
+	}
+
+	if RESPONSESIZE > 0 {
+		writeFiller(writer, RESPONSESIZE)
+		return
+	}
+
+	writeSuccess(writer, entry)
+}
+
+// Register the command line options, setting each to its default.
+func defineFlags() {
+	flag.BoolVar(&RAW, "raw", false, "whether or not to interpret data")
+	flag.BoolVar(&VERBOSE, "verbose", false, "whether or not to log extra detail")
+	flag.BoolVar(&STRICT, "strict", false, "whether or not to reject malformed requests with a 400")
+	flag.BoolVar(&DECODEERRORSFATAL, "decode-errors-fatal", false, "whether or not to answer the first request with decode errors with a 400 and exit with status 1")
+	flag.IntVar(&MAXRATIO, "max-compress-ratio", 0, "maximum gzip expansion ratio, 0 for no limit")
+	flag.StringVar(&RAWBODY, "raw-body", "false", "treat the whole body as the payload: true, false or auto")
+	flag.StringVar(&TRAILERFORMAT, "trailer-format", "text", "how to show body bytes left over by form and multipart parsing: text, hex, base64 or ignore")
+	flag.StringVar(&BODYENCODING, "body-encoding", "utf-8", "encoding of raw bodies for display: utf-8, latin1 or auto")
+	flag.StringVar(&REDIRECT, "redirect", "", "redirect every request to this url instead of processing it")
+	flag.IntVar(&REDIRECTSTATUS, "redirect-status", http.StatusTemporaryRedirect, "status for -redirect: 301, 302, 307 or 308")
+	flag.StringVar(&TLSCERT, "tls-cert", "", "certificate file, serves https when set along with -tls-key")
+	flag.StringVar(&TLSKEY, "tls-key", "", "private key file for -tls-cert")
+	flag.StringVar(&TLSMINVERSION, "tls-min-version", "1.2", "lowest TLS version accepted: 1.2 or 1.3")
+	flag.StringVar(&CLIENTCA, "client-ca", "", "CA file used to verify client certificates, requires TLS")
+	flag.StringVar(&LOGFILE, "log-file", "", "append output to this file instead of stdout, reopening it on SIGHUP so it can be rotated")
+	flag.BoolVar(&ERRORSTOSTDERR, "json-logs-to-stderr", false, "send errors and warnings to stderr, keeping only request logs on stdout")
+	flag.StringVar(&STATSD, "statsd", "", "StatsD UDP address to send request counts, errors and durations to")
+	flag.StringVar(&TAIL, "tail", "", "file or FIFO to append each request entry to as a json line")
+	flag.StringVar(&ONREQUEST, "on-request", "", "shell command run with each request's json on stdin")
+	flag.DurationVar(&ONREQUESTTIMEOUT, "on-request-timeout", 10*time.Second, "time limit for the -on-request command")
+	flag.BoolVar(&NOKEEPALIVE, "disable-keepalive", false, "close the connection after every response")
+	flag.DurationVar(&IDLETIMEOUT, "idle-timeout", 0, "shut down after this long without a request, 0 to never")
+	flag.DurationVar(&KEEPALIVETIMEOUT, "keepalive-timeout", 0, "how long idle connections are kept open, 0 for the default")
+	flag.BoolVar(&VALIDATEONLY, "validate-only", false, "only validate requests and report the result in the response")
+	flag.BoolVar(&TRUSTPROXY, "trust-proxy", false, "take the client address from X-Forwarded-For/X-Real-IP set by trusted proxies")
+	flag.Var(&ALLOWIPS, "allow-ip", "comma separated CIDRs clients must be in, repeatable, everyone when not given")
+	flag.Var(&TRUSTEDPROXIES, "trusted-proxies", "comma separated CIDRs trusted by -trust-proxy (default "+DEFAULTPROXIES+")")
+	flag.Int64Var(&RESPONSESIZE, "response-size", 0, "respond with this many bytes of filler instead of the success message")
+	flag.BoolVar(&RESPONSEINCLUDEID, "response-include-id", false, "add a generated \"id\" and the request \"seq\" number to the success message")
+	flag.BoolVar(&ALLOWSTATUSHEADER, "allow-status-header", false, "respond with the status named in the request's X-Mock-Status header")
+	flag.BoolVar(&ASYNC, "async", false, "answer uploads with a 202 and a /jobs/<id> to poll while they're decoded in the background")
+	flag.DurationVar(&JOBTTL, "job-ttl", 10*time.Minute, "how long a finished -async job can still be polled at /jobs/<id>")
+	flag.BoolVar(&MIRROR, "mirror", false, "respond with the received items as a 201, instead of the success message")
+	flag.BoolVar(&GZIPRESPONSES, "gzip-responses", false, "whether or not to gzip response bodies for clients accepting gzip")
+	flag.BoolVar(&CHUNKEDRESPONSE, "chunked-response", false, "whether or not to send response bodies chunked, in -response-chunks flushed writes")
+	flag.IntVar(&RESPONSECHUNKS, "response-chunks", 4, "how many pieces -chunked-response splits a body into")
+	flag.DurationVar(&CHUNKDELAY, "chunk-delay", 0, "wait between -chunked-response pieces")
+	flag.BoolVar(&APPENDNEWLINE, "append-newline", false, "whether or not to end response bodies with a newline")
+	flag.BoolVar(&REJECTEMPTY, "reject-empty", false, "whether or not to reject requests with an empty body with a 400")
+	flag.BoolVar(&RESUMABLE, "resumable", false, "assemble Content-Range chunks, answering 308 until the upload is complete")
+	flag.StringVar(&UPLOADIDHEADER, "upload-id-header", "X-Upload-ID", "header identifying the upload a -resumable chunk belongs to")
+	flag.IntVar(&MAXJSONDEPTH, "max-json-depth", 10000, "reject item json nesting deeper than this")
+	flag.IntVar(&BASE64DEPTH, "base64-depth", 1, "decode base64 data values up to this many times, while they still decode")
+	flag.StringVar(&DATAFORMAT, "data-format", "raw", "how to show base64 decoded data values: raw or msgpack")
+	flag.StringVar(&PIPELINE, "pipeline", "", "comma separated transforms for data values: base64, gunzip, json, msgpack")
+	flag.StringVar(&HASHALGO, "hash-algo", "none", "hash logged for each file part and decoded dataFile: none, sha256 or crc32")
+	flag.BoolVar(&GZIPBYCONTENTTYPE, "gzip-by-content-type", false, "gunzip parts by their Content-Type or content rather than the dataFile field name")
+	flag.StringVar(&REQUIREFIELDS, "require-fields", "", "comma separated multipart fields every upload must include, rejected under -strict when missing")
+	flag.StringVar(&DATAFILEFORMAT, "datafile-format", "auto", "how to show dataFile contents: auto, csv or text")
+	flag.BoolVar(&DATAFILEJSON, "datafile-json", false, "whether or not to require the decoded dataFile to be json")
+	flag.BoolVar(&PRETTYDATAFILE, "pretty-datafile", false, "whether or not to indent dataFile json checked by -datafile-json")
+	flag.StringVar(&PROTODESCRIPTOR, "proto-descriptor", "", "compiled FileDescriptorSet to decode protobuf dataFiles with, shown much as protojson would; groups, extensions and the json forms of well-known types aren't supported, and unknown fields are kept by number")
+	flag.StringVar(&PROTOMESSAGE, "proto-message", "", "the -proto-descriptor message type dataFiles hold, like bsg.Reading")
+	flag.StringVar(&FORWARD, "forward", "", "also send each request to this url and answer with its response")
+	flag.BoolVar(&SAMPLE, "sample", false, "decompress only the start of dataFile for display, counting the rest, and stream bodies to -store-dir")
+	flag.BoolVar(&COUNTONLY, "count-only", false, "print only a periodic summary instead of each request")
+	flag.DurationVar(&SUMMARYINTERVAL, "summary-interval", 10*time.Second, "how often -count-only prints its summary")
+	flag.StringVar(&RESPONSESFILE, "responses", "", "json file mapping -response-key item values to canned responses")
+	flag.StringVar(&SCENARIOSFILE, "scenarios", "", "json file mapping "+SCENARIOHEADER+" header values to a status, delay and body")
+	flag.StringVar(&PATHRESPONSESFILE, "path-responses", "", "json file mapping /datastore/ path prefixes to templated success responses")
+	flag.StringVar(&RESPONSEKEY, "response-key", "id", "item field looked up in -responses")
+	flag.StringVar(&MANIFESTFILE, "manifest", "", "file of expected item ids, or sha256 hashes of item data, one per line, checked at /manifest/status")
+	flag.StringVar(&MANIFESTKEY, "manifest-key", "id", "item field matched against -manifest ids")
+	flag.StringVar(&PIDFILE, "pid-file", "", "write the process id to this file, removed on shutdown")
+	flag.BoolVar(&FORCE, "force", false, "start even if -pid-file names a running process")
+	flag.BoolVar(&DECODEJWT, "decode-jwt", false, "whether or not to show the claims of bearer JWTs")
+	flag.StringVar(&JWTKEY, "jwt-key", "", "HMAC secret, or RSA public key file, to verify -decode-jwt signatures with")
+	flag.StringVar(&CACHECONTROL, "cache-control", "no-store", "Cache-Control sent on GET responses; other methods always get no-store")
+	flag.StringVar(&REFLECTHEADERS, "reflect-headers", "", "copy request headers starting with this prefix, such as X-Client-, into the response")
+	flag.Var(&RESPONSEHEADERS, "response-header", "'Key: Value' added to responses, may be repeated; prefix with success: or error: to scope it")
+	flag.IntVar(&HISTORY, "history", 1000, "number of recent requests kept for POST /assert and GET /requests, 0 to keep none")
+	flag.BoolVar(&REJECTDUPLICATES, "reject-duplicates", false, "answer a body already received within -duplicate-window with a 409")
+	flag.DurationVar(&DUPLICATEWINDOW, "duplicate-window", time.Minute, "how long a body counts as a duplicate for -reject-duplicates")
+	flag.StringVar(&REDACTFIELDS, "redact-fields", "", "comma separated item fields, or key.field, whose values are logged and stored as ***")
+	flag.StringVar(&STOREDIR, "store-dir", "", "directory to save each request's body in")
+	flag.StringVar(&STOREFORMAT, "store-format", "", "also append a summary of each request to -store-dir: jsonl or csv")
+	flag.BoolVar(&CAPTURERAW, "capture-raw", false, "whether or not to tee each request body into -store-dir as it's read, before any parsing")
+	flag.BoolVar(&STOREREQUIRED, "store-required", false, "whether or not to answer with a 500 when -store-dir can't be written")
+	flag.StringVar(&STOREFIELDS, "store-fields", "", "store a json entry with only these of headers,items,body,files,datafile (files with their data),errors,payload (the payload files too)")
+	flag.BoolVar(&STOREDECODED, "store-decoded", false, "save the decoded payload in -store-dir rather than the raw body")
+	flag.Var(&ADDRS, "addr", "address to listen on, may be repeated (default :8000)")
+	flag.StringVar(&NETWORK, "network", "tcp", "network to listen on: tcp, tcp4 or tcp6")
+	flag.IntVar(&PORT, "port", -1, "port to listen on on all interfaces, 0 for a free one (the chosen address is logged)")
+	flag.BoolVar(&STREAMECHO, "stream-echo", false, "whether or not to echo /datastore/stream messages back")
+	flag.StringVar(&DELAYDIST, "delay-dist", "", "response delay: fixed:D, uniform:MIN-MAX or normal:MEAN-STDDEV")
+	flag.DurationVar(&DELAYPERMB, "delay-per-mb", 0, "extra response delay per MB of decompressed dataFile")
+	flag.DurationVar(&READDELAY, "read-delay-per-chunk", 0, "sleep this long before reading each 32 KiB of a request body")
+	flag.DurationVar(&MAXDELAY, "max-delay", 0, "cap on the -delay-per-mb delay, 0 for none")
+	flag.Float64Var(&FAILRATE, "fail-rate", 0, "fraction of requests, from 0 to 1, failed with -fail-status")
+	flag.IntVar(&FAILSTATUS, "fail-status", http.StatusServiceUnavailable, "status of requests failed by -fail-rate")
+	flag.Int64Var(&FAILAFTERREQUESTS, "fail-after-requests", 0, "only inject -fail-rate failures after this many requests")
+	flag.DurationVar(&FAILAFTERDURATION, "fail-after-duration", 0, "only inject -fail-rate failures once the server has run this long")
+	flag.IntVar(&MAXCONCURRENT, "max-concurrent", 0, "handle at most this many /datastore requests at once, queueing the rest, 0 for no limit")
+	flag.DurationVar(&QUEUETIMEOUT, "queue-timeout", 0, "answer requests queued by -max-concurrent for longer than this with a 503, 0 to wait")
+	flag.DurationVar(&REQUESTTIMEOUT, "request-timeout", 0, "answer /datastore requests taking longer than this with a 503, 0 for no limit")
+	flag.Float64Var(&ABORTRATE, "abort-rate", 0, "fraction of requests, 0 to 1, answered with half a response before the connection is closed")
+	flag.DurationVar(&FAULTDELAY, "fault-delay", 0, "extra delay added to every response for fault injection")
+	flag.StringVar(&ADMINTOKEN, "admin-token", "", "bearer token enabling /admin/faults to change fault injection at runtime")
+	flag.Int64Var(&DELAYSEED, "delay-seed", 1, "random seed for -delay-dist")
+	flag.IntVar(&MAXHEADERBYTES, "max-header-bytes", 0, "largest request header accepted, 0 for the default of 1MB")
+	flag.StringVar(&HMACSECRET, "hmac-secret", "", "verify an HMAC-SHA256 signature of each body with this key")
+	flag.StringVar(&HMACHEADER, "hmac-header", "X-Signature", "request header holding the -hmac-secret signature")
+	flag.BoolVar(&EXPOSECONFIG, "expose-config", false, "whether or not to serve the effective options on GET /config")
+	flag.BoolVar(&QUIET, "quiet", false, "whether or not to leave out the startup summary of active features")
+	flag.StringVar(&CONFIG, "config", "", "json object or yaml file of options keyed by flag name; flags override it, and it overrides the defaults. yaml is limited to 'key: value' lines, indented '- value' lists and # comments, with plain or quoted values")
+}
+
+func main() {
+	defineFlags()
+	flag.Parse()
+
+	if CONFIG != "" {
+		err := loadConfig(CONFIG)
+		if err != nil {
+			fmt.Fprintf(ERRORS, "Error loading config: %s\n", err)
+			os.Exit(2)
+		}
+	}
+
+	if ERRORSTOSTDERR {
+		ERRORS = os.Stderr
+	}
+
+	if PORT >= 0 {
+		ADDRS = append(ADDRS, ":"+strconv.Itoa(PORT))
+	}
+
+	if len(ADDRS) == 0 {
+		ADDRS = stringList{":8000"}
+	}
+
+	if len(TRUSTEDPROXIES) == 0 {
+		TRUSTEDPROXIES.Set(DEFAULTPROXIES)
+	}
+
+	if LOGFILE != "" {
+		var err error
+		logFile, err = openLogFile(LOGFILE)
+		if err != nil {
+			fmt.Fprintf(ERRORS, "Error opening log file: %s\n", err)
+			os.Exit(1)
+		}
+		defer closeLogFile()
+
+		OUTPUT = logFile
+		if !ERRORSTOSTDERR {
+			ERRORS = logFile
+		}
+
+		hangups := make(chan os.Signal, 1)
+		signal.Notify(hangups, syscall.SIGHUP)
+		go reopenOnSignal(hangups)
+	}
+
+	if DELAYDIST != "" {
+		dist, err := parseDelayDist(DELAYDIST)
+		if err != nil {
+			fmt.Fprintf(ERRORS, "Invalid -delay-dist: %s\n", err)
+			exit(2)
+		}
+
+		DELAY = dist
+	}
+
+	if REQUESTTIMEOUT > 0 && (FAULTDELAY >= REQUESTTIMEOUT ||
+		(DELAY.kind == "fixed" && DELAY.first >= REQUESTTIMEOUT)) {
+		fmt.Fprintf(ERRORS, "# WARNING: the response delay is at least -request-timeout, every request will time out\n")
+	}
+
+	if RESPONSESFILE != "" {
+		err := loadResponses(RESPONSESFILE)
+		if err != nil {
+			fmt.Fprintf(ERRORS, "Error loading responses: %s\n", err)
+			exit(2)
+		}
+	}
+
+	if SCENARIOSFILE != "" {
+		err := loadScenarios(SCENARIOSFILE)
+		if err != nil {
+			fmt.Fprintf(ERRORS, "Error loading scenarios: %s\n", err)
+			exit(2)
+		}
+	}
+
+	if PATHRESPONSESFILE != "" {
+		err := loadPathResponses(PATHRESPONSESFILE)
+		if err != nil {
+			fmt.Fprintf(ERRORS, "Error loading path responses: %s\n", err)
+			exit(2)
+		}
+	}
+
+	if MANIFESTFILE != "" {
+		err := loadManifest(MANIFESTFILE)
+		if err != nil {
+			fmt.Fprintf(ERRORS, "Error loading manifest: %s\n", err)
+			exit(2)
+		}
+	}
+
+	// Past a -fail-after threshold everything fails unless -fail-rate says otherwise.
+	if (FAILAFTERREQUESTS > 0 || FAILAFTERDURATION > 0) && FAILRATE == 0 {
+		FAILRATE = 1
+	}
+	faultStart = time.Now()
+
+	if ABORTRATE < 0 || ABORTRATE > 1 {
+		fmt.Fprintf(ERRORS, "Invalid -abort-rate: %v\n", ABORTRATE)
+		exit(2)
+	}
+
+	if FAILRATE != 0 || FAULTDELAY != 0 || ADMINTOKEN != "" {
+		err := setFaults(faultSettings{FailRate: FAILRATE, Delay: FAULTDELAY.String(), Status: FAILSTATUS})
+		if err != nil {
+			fmt.Fprintf(ERRORS, "Invalid fault injection options: %s\n", err)
+			exit(2)
+		}
+	}
+
+	if RAWBODY != "true" && RAWBODY != "false" && RAWBODY != "auto" {
+		fmt.Fprintf(ERRORS, "Invalid -raw-body mode: %s\n", RAWBODY)
+		exit(2)
+	}
+
+	if len(RESPONSEHEADERS) != 0 {
+		headers, err := parseResponseHeaders(RESPONSEHEADERS)
+		if err != nil {
+			fmt.Fprintf(ERRORS, "Invalid -response-header: %s\n", err)
+			exit(2)
+		}
+
+		responseHeaders = headers
+	}
+
+	if NETWORK != "tcp" && NETWORK != "tcp4" && NETWORK != "tcp6" {
+		fmt.Fprintf(ERRORS, "Invalid -network: %s\n", NETWORK)
+		exit(2)
+	}
+
+	if HASHALGO != "none" && HASHALGO != "sha256" && HASHALGO != "crc32" {
+		fmt.Fprintf(ERRORS, "Invalid -hash-algo: %s\n", HASHALGO)
+		exit(2)
+	}
+
+	if DATAFORMAT != "raw" && DATAFORMAT != "msgpack" {
+		fmt.Fprintf(ERRORS, "Invalid -data-format: %s\n", DATAFORMAT)
+		exit(2)
+	}
+
+	if MAXJSONDEPTH < 1 {
+		fmt.Fprintf(ERRORS, "Invalid -max-json-depth: %d\n", MAXJSONDEPTH)
+		exit(2)
+	}
+
+	if names, err := parsePipeline(PIPELINE); err != nil {
+		fmt.Fprintf(ERRORS, "Invalid -pipeline: %s\n", err)
+		exit(2)
+	} else {
+		pipeline = names
+	}
+
+	if DATAFILEFORMAT != "auto" && DATAFILEFORMAT != "csv" && DATAFILEFORMAT != "text" {
+		fmt.Fprintf(ERRORS, "Invalid -datafile-format: %s\n", DATAFILEFORMAT)
+		exit(2)
+	}
+
+	if (PROTODESCRIPTOR == "") != (PROTOMESSAGE == "") {
+		fmt.Fprintf(ERRORS, "-proto-descriptor and -proto-message must be used together\n")
+		exit(2)
+	} else if PROTODESCRIPTOR != "" {
+		err := loadProtoDescriptor(PROTODESCRIPTOR, PROTOMESSAGE)
+		if err != nil {
+			fmt.Fprintf(ERRORS, "Error loading -proto-descriptor: %s\n", err)
+			exit(2)
+		}
+	}
+
+	if STOREFIELDS != "" {
+		fields, err := parseStoreFields(STOREFIELDS)
+		if err != nil {
+			fmt.Fprintf(ERRORS, "Invalid -store-fields: %s\n", err)
+			exit(2)
+		}
+
+		storeFields = fields
+	}
+
+	if STOREDIR != "" {
+		err := os.MkdirAll(STOREDIR, 0755)
+		if err != nil {
+			fmt.Fprintf(ERRORS, "Error creating -store-dir: %s\n", err)
+			exit(1)
+		}
+	}
+
+	if STOREFORMAT != "" && STOREFORMAT != "jsonl" && STOREFORMAT != "csv" {
+		fmt.Fprintf(ERRORS, "Invalid -store-format: %s\n", STOREFORMAT)
+		exit(2)
+	}
+
+	if STOREFORMAT != "" && STOREDIR != "" {
+		err := openStoreIndex()
+		if err != nil {
+			fmt.Fprintf(ERRORS, "Error opening -store-format summary: %s\n", err)
+			exit(1)
+		}
+		defer storeIndex.Close()
+	}
+
+	if CAPTURERAW && (STOREDIR == "" || REDACTFIELDS != "") {
+		fmt.Fprintf(ERRORS, "-capture-raw requires -store-dir, and can't be used with -redact-fields\n")
+		exit(2)
+	}
+
+	if REDACTFIELDS != "" {
+		redactFields = parseRedactFields(REDACTFIELDS)
+	}
+
+	if SAMPLE {
+		var whole []string
+		if FORWARD != "" {
+			whole = append(whole, "-forward")
+		}
+		if HMACSECRET != "" {
+			whole = append(whole, "-hmac-secret")
+		}
+		if REJECTDUPLICATES {
+			whole = append(whole, "-reject-duplicates")
+		}
+
+		if len(whole) != 0 {
+			fmt.Fprintf(ERRORS, "# WARNING: %s read the whole body, so -sample still holds each upload in memory\n",
+				strings.Join(whole, ", "))
+		}
+	}
+
+	if MAXCONCURRENT < 0 {
+		fmt.Fprintf(ERRORS, "Invalid -max-concurrent: %d\n", MAXCONCURRENT)
+		exit(2)
+	}
+
+	if MAXCONCURRENT > 0 {
+		slots = make(chan struct{}, MAXCONCURRENT)
+	}
+
+	// TimeoutHandler buffers the whole response, so it can't be sent in pieces.
+	if CHUNKEDRESPONSE && REQUESTTIMEOUT > 0 {
+		fmt.Fprintf(ERRORS, "-chunked-response can't be used with -request-timeout\n")
+		exit(2)
+	}
+
+	if RESPONSECHUNKS < 1 {
+		fmt.Fprintf(ERRORS, "Invalid -response-chunks: %d\n", RESPONSECHUNKS)
+		exit(2)
+	}
+
+	switch TRAILERFORMAT {
+	case "text", "hex", "base64", "ignore":
+	default:
+		fmt.Fprintf(ERRORS, "Invalid -trailer-format: %s\n", TRAILERFORMAT)
+		exit(2)
+	}
+
+	if BODYENCODING != "utf-8" && BODYENCODING != "latin1" && BODYENCODING != "auto" {
+		fmt.Fprintf(ERRORS, "Invalid -body-encoding: %s\n", BODYENCODING)
+		exit(2)
+	}
+
+	switch REDIRECTSTATUS {
+	case http.StatusMovedPermanently, http.StatusFound,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		fmt.Fprintf(ERRORS, "Invalid -redirect-status: %d\n", REDIRECTSTATUS)
+		exit(2)
+	}
+
+	if CLIENTCA != "" && TLSCERT == "" {
+		fmt.Fprintf(ERRORS, "-client-ca requires -tls-cert and -tls-key\n")
+		exit(2)
+	}
+
+	minVersion, ok := TLSVERSIONS[TLSMINVERSION]
+	if !ok {
+		fmt.Fprintf(ERRORS, "Invalid -tls-min-version: %s\n", TLSMINVERSION)
+		exit(2)
+	}
+
+	// TimeoutHandler cancels the request's context once the timeout passes.  Slow reads
+	// and delays wait on that context, so they stop then.  Decoding doesn't check it, and
+	// anything new that might block for long has to check it too, or it keeps running
+	// after the 503 has gone out.
+	handler := display
+	if REQUESTTIMEOUT > 0 {
+		body, _ := json.Marshal(map[string]string{
+			"success": "false",
+			"error":   "request timed out after " + REQUESTTIMEOUT.String(),
+		})
+		handler = callbacksAfter(http.TimeoutHandler(http.HandlerFunc(handler), REQUESTTIMEOUT, string(body)).ServeHTTP)
+	}
+
+	if ASYNC {
+		handler = acceptAsync(handler)
+		http.HandleFunc("/jobs/", cacheControl(showJob))
+	}
+
+	http.HandleFunc("/datastore", cacheControl(handler))
+	http.HandleFunc("/datastore/stream", stream)
+
+	for _, pattern := range pathPatterns() {
+		http.HandleFunc(pattern, cacheControl(handler))
+	}
+	http.HandleFunc("/live", live)
+
+	if EXPOSECONFIG {
+		http.HandleFunc("/config", cacheControl(showConfig))
+	}
+
+	if ADMINTOKEN != "" {
+		http.HandleFunc("/admin/faults", cacheControl(adminFaults))
+	}
+
+	http.HandleFunc("/stats", cacheControl(showStats))
+	http.HandleFunc("/stats/clients", cacheControl(showClients))
+
+	if MANIFESTFILE != "" {
+		http.HandleFunc("/manifest/status", cacheControl(manifestStatus))
+	}
+
+	if HISTORY > 0 {
+		http.HandleFunc("/assert", cacheControl(assertRequests))
+		http.HandleFunc("/export/har", cacheControl(exportHAR))
+		http.HandleFunc("/requests", cacheControl(listRequests))
+	}
+
+	if HISTORY > 0 || STOREDIR != "" {
+		http.HandleFunc("/export/zip", cacheControl(exportZip))
+	}
+
+	server := &http.Server{IdleTimeout: KEEPALIVETIMEOUT, MaxHeaderBytes: MAXHEADERBYTES}
+	server.SetKeepAlivesEnabled(!NOKEEPALIVE)
+
+	var root http.Handler = http.DefaultServeMux
+	if IDLETIMEOUT > 0 {
+		root = trackActivity(root)
+	}
+
+	// Blocked clients don't count as activity for -idle-timeout.
+	if len(ALLOWIPS) != 0 {
+		root = allowClients(root)
+	}
+	server.Handler = root
+
+	server.TLSConfig = &tls.Config{MinVersion: minVersion}
+
+	if CLIENTCA != "" {
+		pem, err := ioutil.ReadFile(CLIENTCA)
+		if err != nil {
+			fmt.Fprintf(ERRORS, "Error reading client CA: %s\n", err)
+			exit(1)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			fmt.Fprintf(ERRORS, "No certificates found in %s\n", CLIENTCA)
+			exit(1)
+		}
+
+		// Unverified clients still reach display so they can be answered with a 403.
+		server.TLSConfig.ClientCAs = pool
+		server.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	// Checked before binding, so a second instance fails without taking the port.
+	if PIDFILE != "" {
+		err := writePIDFile(PIDFILE)
+		if err != nil {
+			fmt.Fprintf(ERRORS, "Error writing pid file: %s\n", err)
+			exit(1)
+		}
+		defer os.Remove(PIDFILE)
+	}
+
+	var listeners []net.Listener
+	for _, addr := range ADDRS {
+		listener, err := net.Listen(NETWORK, addr)
+		if err != nil {
+			fmt.Fprintf(ERRORS, "Error listening on %s: %s\n", addr, err)
+			if PIDFILE != "" {
+				os.Remove(PIDFILE)
+			}
+			exit(1)
+		}
+
+		fmt.Fprintf(OUTPUT, "# listening on %s (%s)\n", listener.Addr(), addressFamily(listener.Addr()))
+		listeners = append(listeners, listener)
+	}
+
+	if !QUIET {
+		printBanner(OUTPUT)
+	}
+
+	// net/http answers oversized headers with a 431 itself, before any handler runs, so
+	// those rejections can't be logged per request.
+	if MAXHEADERBYTES > 0 {
+		fmt.Fprintf(OUTPUT, "# requests with headers over %d bytes get a 431\n", MAXHEADERBYTES)
+	}
+
+	// Request blocks are still built, but go nowhere.  Summaries from here on go to the
+	// console, and errors to ERRORS as before.
+	console := OUTPUT
+	if COUNTONLY {
+		OUTPUT = ioutil.Discard
+		go printSummaries(console)
+	}
+
+	if TAIL != "" {
+		go tailEntries(TAIL, console)
+	}
+
+	if STATSD != "" {
+		conn, err := net.Dial("udp", STATSD)
+		if err != nil {
+			fmt.Fprintf(ERRORS, "Invalid -statsd: %s\n", err)
+			exit(2)
+		}
+
+		go sendStatsd(conn, ERRORS)
+	}
+
+	// Never closed without -idle-timeout.
+	idle := make(chan struct{})
+	if IDLETIMEOUT > 0 {
+		go waitIdle(console, idle)
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+		select {
+		case <-signals:
+		case <-idle:
+		case <-decodeFailed:
+		}
+
+		err := server.Shutdown(context.Background())
+		if err != nil {
+			fmt.Fprintf(ERRORS, "Error shutting down: %s\n", err)
+		}
+		close(stopped)
+	}()
+
+	// Shutdown closes every listener, so each of these returns ErrServerClosed.
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			if TLSCERT != "" {
+				errs <- server.ServeTLS(listener, TLSCERT, TLSKEY)
+			} else {
+				errs <- server.Serve(listener)
+			}
+		}(listener)
+	}
+
+	err := <-errs
+	if err != http.ErrServerClosed {
+		fmt.Fprintf(ERRORS, "Error serving: %s\n", err)
+		return
+	}
+
+	<-stopped
+
+	// exit only closes the log file, so the pid file goes first.
+	select {
+	case <-decodeFailed:
+		if PIDFILE != "" {
+			os.Remove(PIDFILE)
+		}
+		exit(1)
+	default:
 	}
 }
@@ -0,0 +1,1017 @@
+package main
+
+import "bufio"
+import "bytes"
+import "compress/gzip"
+import "context"
+import "crypto/tls"
+import "crypto/x509"
+import "crypto/x509/pkix"
+import "encoding/base64"
+import "encoding/json"
+import "flag"
+import "io/ioutil"
+import "math/big"
+import "mime/multipart"
+import "net"
+import "net/http"
+import "net/http/httptest"
+import "net/url"
+import "os"
+import "regexp"
+import "sort"
+import "strconv"
+import "sync/atomic"
+import "strings"
+import "sync"
+import "testing"
+import "time"
+
+func TestMain(m *testing.M) {
+	defineFlags()
+	flag.Parse()
+
+	// Set up from the defaults as main does.
+	pipeline, _ = parsePipeline(PIPELINE)
+
+	OUTPUT = ioutil.Discard
+	ERRORS = ioutil.Discard
+
+	os.Exit(m.Run())
+}
+
+// Set a command line option for the rest of a test, restoring it afterwards.
+func setFlag(t *testing.T, name, value string) {
+	t.Helper()
+
+	previous := flag.Lookup(name).Value.String()
+	err := flag.Set(name, value)
+	if err != nil {
+		t.Fatalf("setting -%s: %s", name, err)
+	}
+
+	t.Cleanup(func() {
+		flag.Set(name, previous)
+	})
+}
+
+// POST form values to handler, returning the recorded response.
+func postForm(handler http.HandlerFunc, values url.Values) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/datastore", strings.NewReader(values.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	recorder := httptest.NewRecorder()
+	handler(recorder, request)
+
+	return recorder
+}
+
+// Decode a json response body, failing the test if it isn't json.
+func decodeResponse(t *testing.T, body []byte) map[string]interface{} {
+	t.Helper()
+
+	var decoded map[string]interface{}
+	err := json.Unmarshal(bytes.TrimSpace(body), &decoded)
+	if err != nil {
+		t.Fatalf("response %q isn't json: %s", body, err)
+	}
+
+	return decoded
+}
+
+func TestAsyncAbort(t *testing.T) {
+	setFlag(t, "abort-rate", "1")
+
+	response := postForm(acceptAsync(display), url.Values{"item": {`{"id":"1"}`}})
+	if response.Code != http.StatusAccepted {
+		t.Fatalf("status %d, want %d", response.Code, http.StatusAccepted)
+	}
+
+	id := decodeResponse(t, response.Body.Bytes())["job_id"].(string)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		jobsLock.Lock()
+		status := jobs[id].Status
+		jobsLock.Unlock()
+
+		if status == "failed" {
+			return
+		}
+
+		if status != "pending" {
+			t.Fatalf("aborted job is %s, want failed", status)
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("job still pending")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStoreDecodedRepeatedNames(t *testing.T) {
+	base := t.TempDir() + "/1"
+	entry := &RequestEntry{decoded: []decodedPart{
+		{"a/b", []byte("first")},
+		{"a/b", []byte("second")},
+	}}
+
+	err := storeDecoded(base, entry)
+	if err != nil {
+		t.Fatalf("storing: %s", err)
+	}
+
+	for name, want := range map[string]string{base + ".a_b": "first", base + ".a_b.1": "second"} {
+		data, err := ioutil.ReadFile(name)
+		if err != nil || string(data) != want {
+			t.Errorf("%s holds %q (%v), want %q", name, data, err, want)
+		}
+	}
+}
+
+func TestValidateOnlyStoresNothing(t *testing.T) {
+	dir := t.TempDir()
+	setFlag(t, "validate-only", "true")
+	setFlag(t, "store-dir", dir)
+	setFlag(t, "capture-raw", "true")
+
+	before := len(rememberedRequests())
+	response := postForm(display, url.Values{"item": {`{"id":"1"}`}})
+	if _, ok := decodeResponse(t, response.Body.Bytes())["valid"]; !ok {
+		t.Fatalf("no validation result in %s", response.Body)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 0 {
+		t.Errorf("stored %d files under -validate-only", len(files))
+	}
+
+	if len(rememberedRequests()) != before {
+		t.Errorf("remembered a -validate-only request")
+	}
+}
+
+func TestChunksStopForCancelledClient(t *testing.T) {
+	setFlag(t, "response-chunks", "4")
+	setFlag(t, "chunk-delay", "1h")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	response := httptest.NewRecorder()
+	writeChunks(&statusRecorder{ResponseWriter: response, ctx: ctx}, []byte("0123456789abcdef"))
+
+	if response.Body.String() != "0123" {
+		t.Errorf("sent %q to a cancelled client, want only the first chunk", response.Body)
+	}
+}
+
+// Gzip data, as clients send a dataFile.
+func gzipped(data []byte) []byte {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(data)
+	writer.Close()
+
+	return compressed.Bytes()
+}
+
+// A multipart upload of dataFile to target, accepting gzipped responses.
+func dataFileRequest(target string, dataFile []byte) *http.Request {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("dataFile", "data.gz")
+	part.Write(dataFile)
+	form.Close()
+
+	request := httptest.NewRequest(http.MethodPost, target, &body)
+	request.Header.Set("Content-Type", form.FormDataContentType())
+	request.Header.Set("Accept-Encoding", "gzip")
+
+	return request
+}
+
+func TestGzipEcho(t *testing.T) {
+	setFlag(t, "gzip-responses", "true")
+
+	data := []byte(`{"serial":"1","type":"x"}`)
+	response := httptest.NewRecorder()
+	display(response, dataFileRequest("/datastore?echo=true", gzipped(data)))
+
+	if encoding := response.Header().Get("Content-Encoding"); encoding != "gzip" {
+		t.Fatalf("Content-Encoding %q, want gzip", encoding)
+	}
+
+	reader, err := gzip.NewReader(response.Body)
+	if err != nil {
+		t.Fatalf("response isn't gzipped: %s", err)
+	}
+
+	echoed, _ := ioutil.ReadAll(reader)
+	if !bytes.Equal(echoed, data) {
+		t.Errorf("echoed %q, want %q compressed once", echoed, data)
+	}
+}
+
+func TestGzipNoContent(t *testing.T) {
+	setFlag(t, "gzip-responses", "true")
+	setFlag(t, "allow-status-header", "true")
+
+	request := dataFileRequest("/datastore", gzipped([]byte("{}")))
+	request.Header.Set(STATUSHEADER, "204")
+
+	response := httptest.NewRecorder()
+	display(response, request)
+
+	if response.Code != http.StatusNoContent {
+		t.Fatalf("status %d, want %d", response.Code, http.StatusNoContent)
+	}
+
+	if encoding := response.Header().Get("Content-Encoding"); encoding != "" || response.Body.Len() != 0 {
+		t.Errorf("204 sent with Content-Encoding %q and %d bytes", encoding, response.Body.Len())
+	}
+}
+
+func TestGzipAlreadyEncoded(t *testing.T) {
+	body := gzipped([]byte("upstream"))
+
+	response := httptest.NewRecorder()
+	writer := &gzipResponseWriter{ResponseWriter: response}
+	writer.Header().Set("Content-Encoding", "gzip")
+	writer.Write(body)
+	writer.Close()
+
+	if !bytes.Equal(response.Body.Bytes(), body) {
+		t.Errorf("an already gzipped body was compressed again")
+	}
+}
+
+// Capture everything logged to OUTPUT for the rest of a test.
+func captureOutput(t *testing.T) *bytes.Buffer {
+	var output bytes.Buffer
+
+	previous := OUTPUT
+	OUTPUT = &output
+	t.Cleanup(func() {
+		OUTPUT = previous
+	})
+
+	return &output
+}
+
+func TestRedactRawJSONBody(t *testing.T) {
+	dir := t.TempDir()
+	setFlag(t, "raw-body", "true")
+	setFlag(t, "store-dir", dir)
+	setFlag(t, "store-decoded", "true")
+
+	previous := redactFields
+	redactFields = parseRedactFields("serial")
+	t.Cleanup(func() {
+		redactFields = previous
+	})
+
+	output := captureOutput(t)
+
+	body := `{"device":{"serial":"SECRET-1234","type":"x"},"count":2}`
+	request := httptest.NewRequest(http.MethodPost, "/datastore", strings.NewReader(body))
+	request.Header.Set("Content-Type", "application/json")
+	display(httptest.NewRecorder(), request)
+
+	if strings.Contains(output.String(), "SECRET") {
+		t.Errorf("redacted field logged:\n%s", output)
+	}
+
+	if !strings.Contains(output.String(), REDACTED) {
+		t.Errorf("body not shown redacted:\n%s", output)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) == 0 {
+		t.Fatalf("nothing stored")
+	}
+
+	for _, file := range files {
+		data, _ := ioutil.ReadFile(dir + "/" + file.Name())
+		if bytes.Contains(data, []byte("SECRET")) {
+			t.Errorf("redacted field stored in %s", file.Name())
+		}
+	}
+}
+
+func TestConcurrentSeq(t *testing.T) {
+	const requests = 1000
+	const workers = 50
+
+	setFlag(t, "response-include-id", "true")
+	output := captureOutput(t)
+
+	server := httptest.NewServer(http.HandlerFunc(display))
+	defer server.Close()
+
+	seqs := make(chan int64, requests)
+	work := make(chan int)
+	var wait sync.WaitGroup
+
+	for worker := 0; worker < workers; worker++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+
+			for range work {
+				response, err := http.PostForm(server.URL+"/datastore", url.Values{"item": {`{"id":"1"}`}})
+				if err != nil {
+					t.Errorf("posting: %s", err)
+					continue
+				}
+
+				body, _ := ioutil.ReadAll(response.Body)
+				response.Body.Close()
+
+				var decoded struct{ Seq int64 }
+				json.Unmarshal(body, &decoded)
+				seqs <- decoded.Seq
+			}
+		}()
+	}
+
+	for index := 0; index < requests; index++ {
+		work <- index
+	}
+	close(work)
+	wait.Wait()
+	close(seqs)
+
+	var received []int64
+	for seq := range seqs {
+		received = append(received, seq)
+	}
+
+	if len(received) != requests {
+		t.Fatalf("%d responses, want %d", len(received), requests)
+	}
+
+	sort.Slice(received, func(first, second int) bool {
+		return received[first] < received[second]
+	})
+
+	for index := 1; index < len(received); index++ {
+		if received[index] != received[index-1]+1 {
+			t.Fatalf("seq %d follows %d, want no gaps or repeats", received[index], received[index-1])
+		}
+	}
+
+	// Every block has the one seq line, for a seq answered with, and nothing else's.
+	blocks := strings.Split(output.String(), "######\n\n\n")
+	logged := make(map[int64]bool)
+	seqLine := regexp.MustCompile(`(?m)^# seq (\d+)$`)
+
+	for _, block := range blocks[:len(blocks)-1] {
+		found := seqLine.FindAllStringSubmatch(block, -1)
+		if len(found) != 1 || strings.Count(block, "# POST request") != 1 {
+			t.Fatalf("interleaved block:\n%s", block)
+		}
+
+		seq, _ := strconv.ParseInt(found[0][1], 10, 64)
+		logged[seq] = true
+	}
+
+	for _, seq := range received {
+		if !logged[seq] {
+			t.Errorf("seq %d was answered but not logged", seq)
+		}
+	}
+}
+
+// Send message over a websocket to stream and close it, returning once stream has
+// finished with the connection.
+func sendWebsocketMessage(t *testing.T, message []byte) {
+	t.Helper()
+
+	// The websocket hijacks its connection, so Close won't wait for the handler.
+	finished := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		defer close(finished)
+		stream(writer, request)
+	}))
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dialing: %s", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("GET /datastore/stream HTTP/1.1\r\nHost: test\r\n" +
+		"Connection: Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"))
+
+	// Clients mask every frame; a zero mask leaves the payload as it is.
+	frame := append([]byte{0x80 | opText, 0x80 | byte(len(message)), 0, 0, 0, 0}, message...)
+	frame = append(frame, 0x80|opClose, 0x80, 0, 0, 0, 0)
+
+	conn.Write(frame)
+	ioutil.ReadAll(conn)
+	<-finished
+}
+
+func TestWebsocketBookkeeping(t *testing.T) {
+	dir := t.TempDir()
+	setFlag(t, "store-dir", dir)
+
+	requests := atomic.LoadInt64(&requestCount)
+	sendWebsocketMessage(t, []byte(`{"id":"ws-1"}`))
+
+	if atomic.LoadInt64(&requestCount) != requests+1 {
+		t.Errorf("websocket message not counted in /stats")
+	}
+
+	remembered := rememberedRequests()
+	last := remembered[len(remembered)-1]
+	if last.Method != "WEBSOCKET" || last.Values["body"][0]["id"] != "ws-1" {
+		t.Errorf("websocket message not in the history: %+v", last)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) == 0 {
+		t.Errorf("websocket message not stored")
+	}
+}
+
+func TestWebsocketValidateOnly(t *testing.T) {
+	dir := t.TempDir()
+	setFlag(t, "store-dir", dir)
+	setFlag(t, "validate-only", "true")
+
+	output := captureOutput(t)
+	before := len(rememberedRequests())
+	sendWebsocketMessage(t, []byte(`{"id":"ws-validate"}`))
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("-validate-only stored %d files", len(files))
+	}
+
+	if len(rememberedRequests()) != before {
+		t.Errorf("-validate-only message kept in the history")
+	}
+
+	if !strings.Contains(output.String(), "# validation") {
+		t.Errorf("message not validated:\n%s", output)
+	}
+}
+
+func TestWebsocketNoSlot(t *testing.T) {
+	previous := slots
+	slots = make(chan struct{}, 1)
+	slots <- struct{}{}
+	defer func() {
+		slots = previous
+	}()
+	setFlag(t, "queue-timeout", "10ms")
+
+	output := captureOutput(t)
+	sendWebsocketMessage(t, []byte(`{"id":"ws-busy"}`))
+
+	if !strings.Contains(output.String(), "got no slot, connection closed") {
+		t.Errorf("message without a slot not refused:\n%s", output)
+	}
+}
+
+func TestClientCertOnEntry(t *testing.T) {
+	setFlag(t, "client-ca", "ca.pem")
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "device-7"}, SerialNumber: big.NewInt(4242)}
+
+	request := httptest.NewRequest(http.MethodPost, "/datastore", strings.NewReader("item=%7B%7D"))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert}},
+	}
+	display(httptest.NewRecorder(), request)
+
+	remembered := rememberedRequests()
+	last := remembered[len(remembered)-1]
+	if last.CertSubject != "CN=device-7" || last.CertSerial != "4242" {
+		t.Errorf("entry has certificate %q serial %q", last.CertSubject, last.CertSerial)
+	}
+}
+
+func TestSampleStoresThroughTee(t *testing.T) {
+	dir := t.TempDir()
+	setFlag(t, "sample", "true")
+	setFlag(t, "store-dir", dir)
+
+	data := bytes.Repeat([]byte(`{"serial":"1","type":"x"}`), 1000)
+	request := dataFileRequest("/datastore", gzipped(data))
+	sent, _ := ioutil.ReadAll(request.Body)
+	request.Body = ioutil.NopCloser(bytes.NewReader(sent))
+
+	display(httptest.NewRecorder(), request)
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 || !strings.HasSuffix(files[0].Name(), ".raw") {
+		t.Fatalf("stored %v, want one .raw file", files)
+	}
+
+	stored, _ := ioutil.ReadFile(dir + "/" + files[0].Name())
+	if !bytes.Equal(stored, sent) {
+		t.Errorf("stored %d bytes, want the %d sent", len(stored), len(sent))
+	}
+}
+
+// The most recently remembered request.
+func lastEntry(t *testing.T) *RequestEntry {
+	t.Helper()
+
+	remembered := rememberedRequests()
+	if len(remembered) == 0 {
+		t.Fatalf("no requests remembered")
+	}
+
+	return remembered[len(remembered)-1]
+}
+
+func TestURLEncodedItems(t *testing.T) {
+	output := captureOutput(t)
+
+	data := base64.StdEncoding.EncodeToString([]byte("hello"))
+	response := postForm(display, url.Values{"item": {`{"id":"form-1","data":"` + data + `"}`}})
+	if response.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d", response.Code, http.StatusOK)
+	}
+
+	items := lastEntry(t).Values["item"]
+	if len(items) != 1 || items[0]["id"] != "form-1" || items[0]["data"] != "hello" {
+		t.Errorf("decoded items %v", items)
+	}
+
+	if !strings.Contains(output.String(), "# form values:") || !strings.Contains(output.String(), "#\t\tdata: hello") {
+		t.Errorf("form items not logged:\n%s", output)
+	}
+}
+
+func TestJSONBodyIsNotAMultipartError(t *testing.T) {
+	output := captureOutput(t)
+
+	request := httptest.NewRequest(http.MethodPost, "/datastore", strings.NewReader(`{"id":"1"}`))
+	request.Header.Set("Content-Type", "application/json")
+	display(httptest.NewRecorder(), request)
+
+	if strings.Contains(output.String(), "isn't multipart") || strings.Contains(output.String(), "# Error") {
+		t.Errorf("benign not-multipart case logged as an error:\n%s", output)
+	}
+
+	if errors := lastEntry(t).Errors; len(errors) != 0 {
+		t.Errorf("entry has errors %v", errors)
+	}
+}
+
+func TestRejectEmpty(t *testing.T) {
+	setFlag(t, "reject-empty", "true")
+
+	response := httptest.NewRecorder()
+	display(response, httptest.NewRequest(http.MethodPost, "/datastore", strings.NewReader("")))
+
+	if response.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want %d", response.Code, http.StatusBadRequest)
+	}
+
+	if message := decodeResponse(t, response.Body.Bytes())["error"]; message != "request body is empty" {
+		t.Errorf("error %q, want a description of the empty body", message)
+	}
+
+	response = postForm(display, url.Values{"item": {`{"id":"1"}`}})
+	if response.Code != http.StatusOK {
+		t.Errorf("non-empty body got status %d, want %d", response.Code, http.StatusOK)
+	}
+}
+
+func TestGzipChecksumMismatch(t *testing.T) {
+	corrupt := gzipped([]byte(`{"serial":"1"}`))
+	corrupt[len(corrupt)-8] ^= 0xff
+
+	_, err := decompress(corrupt)
+	if err != ErrChecksum {
+		t.Fatalf("decompress gave %v, want %v", err, ErrChecksum)
+	}
+
+	output := captureOutput(t)
+	display(httptest.NewRecorder(), dataFileRequest("/datastore", corrupt))
+
+	if !strings.Contains(output.String(), "# gzip checksum mismatch\n") {
+		t.Errorf("checksum mismatch not logged:\n%s", output)
+	}
+}
+
+func TestDataFileJSON(t *testing.T) {
+	setFlag(t, "datafile-json", "true")
+	setFlag(t, "pretty-datafile", "true")
+	setFlag(t, "strict", "true")
+
+	output := captureOutput(t)
+	response := httptest.NewRecorder()
+	display(response, dataFileRequest("/datastore", gzipped([]byte(`{"serial":"1"}`))))
+
+	if response.Code != http.StatusOK {
+		t.Errorf("valid json dataFile got status %d, want %d", response.Code, http.StatusOK)
+	}
+
+	if !strings.Contains(output.String(), "{\n  \"serial\": \"1\"\n}") {
+		t.Errorf("valid json dataFile not pretty printed:\n%s", output)
+	}
+
+	response = httptest.NewRecorder()
+	display(response, dataFileRequest("/datastore", gzipped([]byte("serial=1"))))
+
+	if response.Code != http.StatusBadRequest {
+		t.Errorf("invalid json dataFile got status %d, want %d", response.Code, http.StatusBadRequest)
+	}
+
+	if !strings.Contains(output.String(), "# Error dataFile is not valid json") {
+		t.Errorf("invalid json dataFile not logged:\n%s", output)
+	}
+}
+
+func TestSniffMissingContentType(t *testing.T) {
+	output := captureOutput(t)
+
+	values := url.Values{"item": {`{"id":"sniffed-1"}`}}
+	display(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/datastore", strings.NewReader(values.Encode())))
+
+	if !strings.Contains(output.String(), "# WARNING: no Content-Type header, sniffed application/x-www-form-urlencoded\n") {
+		t.Errorf("sniffed form not logged:\n%s", output)
+	}
+
+	if items := lastEntry(t).Values["item"]; len(items) != 1 || items[0]["id"] != "sniffed-1" {
+		t.Errorf("sniffed form decoded to %v", items)
+	}
+
+	display(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/datastore", strings.NewReader(`{"id":"sniffed-2"}`)))
+
+	if !strings.Contains(output.String(), "# WARNING: no Content-Type header, sniffed application/json\n") {
+		t.Errorf("sniffed json not logged:\n%s", output)
+	}
+
+	if body := lastEntry(t).Values["body"]; len(body) != 1 || body[0]["id"] != "sniffed-2" {
+		t.Errorf("sniffed json body decoded to %v", body)
+	}
+}
+
+func TestAppendNewline(t *testing.T) {
+	setFlag(t, "append-newline", "true")
+	setFlag(t, "chunked-response", "true")
+	setFlag(t, "response-chunks", "3")
+	setFlag(t, "chunk-delay", "10ms")
+
+	server := httptest.NewServer(http.HandlerFunc(display))
+	defer server.Close()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	response, err := client.PostForm(server.URL+"/datastore", url.Values{"item": {`{"id":"1"}`}})
+	if err != nil {
+		t.Fatalf("posting: %s", err)
+	}
+	defer response.Body.Close()
+
+	line, err := bufio.NewReader(response.Body).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading a line of %q: %s", line, err)
+	}
+
+	if decoded := decodeResponse(t, []byte(line)); decoded["success"] != "true" {
+		t.Errorf("response line %q", line)
+	}
+}
+
+func TestMultipartMissingBoundary(t *testing.T) {
+	output := captureOutput(t)
+
+	request := httptest.NewRequest(http.MethodPost, "/datastore", strings.NewReader("--x\r\n\r\n--x--\r\n"))
+	request.Header.Set("Content-Type", "multipart/form-data")
+
+	response := httptest.NewRecorder()
+	display(response, request)
+
+	if response.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want %d", response.Code, http.StatusBadRequest)
+	}
+
+	if message := decodeResponse(t, response.Body.Bytes())["error"]; message != "multipart Content-Type missing boundary" {
+		t.Errorf("error %q", message)
+	}
+
+	if !strings.Contains(output.String(), "# Error multipart Content-Type missing boundary\n") {
+		t.Errorf("missing boundary not logged:\n%s", output)
+	}
+}
+
+func TestRequireFields(t *testing.T) {
+	setFlag(t, "require-fields", "dataFile,item")
+	setFlag(t, "strict", "true")
+
+	output := captureOutput(t)
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	form.WriteField("item", `{"id":"1"}`)
+	form.Close()
+
+	request := httptest.NewRequest(http.MethodPost, "/datastore", &body)
+	request.Header.Set("Content-Type", form.FormDataContentType())
+
+	response := httptest.NewRecorder()
+	display(response, request)
+
+	if response.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want %d", response.Code, http.StatusBadRequest)
+	}
+
+	if !strings.Contains(output.String(), "# MISSING required field: dataFile\n") {
+		t.Errorf("missing dataFile not logged:\n%s", output)
+	}
+
+	if strings.Contains(output.String(), "# MISSING required field: item") {
+		t.Errorf("item reported missing:\n%s", output)
+	}
+}
+
+func TestEmptyDataFilePart(t *testing.T) {
+	output := captureOutput(t)
+
+	response := httptest.NewRecorder()
+	display(response, dataFileRequest("/datastore", nil))
+
+	if response.Code != http.StatusOK {
+		t.Errorf("status %d, want %d", response.Code, http.StatusOK)
+	}
+
+	if !strings.Contains(output.String(), "# WARNING: empty part 'dataFile'\n") {
+		t.Errorf("empty part not logged:\n%s", output)
+	}
+
+	if strings.Contains(output.String(), "# Error") {
+		t.Errorf("empty part was decoded:\n%s", output)
+	}
+
+	setFlag(t, "require-fields", "dataFile")
+	setFlag(t, "strict", "true")
+
+	response = httptest.NewRecorder()
+	display(response, dataFileRequest("/datastore", nil))
+
+	if response.Code != http.StatusBadRequest {
+		t.Errorf("empty required part got status %d, want %d", response.Code, http.StatusBadRequest)
+	}
+}
+
+func TestGzipHeaderFilename(t *testing.T) {
+	output := captureOutput(t)
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Name = "device-7.json"
+	writer.Comment = "uploader 2.1"
+	writer.Write([]byte(`{"serial":"1"}`))
+	writer.Close()
+
+	display(httptest.NewRecorder(), dataFileRequest("/datastore", compressed.Bytes()))
+
+	for _, line := range []string{"# gzip name: device-7.json\n", "# gzip comment: uploader 2.1\n"} {
+		if !strings.Contains(output.String(), line) {
+			t.Errorf("%q not logged:\n%s", line, output)
+		}
+	}
+
+	files := lastEntry(t).Files
+	if len(files) != 1 || files[0].Gzip == nil {
+		t.Fatalf("entry files %v have no gzip header", files)
+	}
+
+	if metadata := files[0].Gzip; metadata.Name != "device-7.json" || metadata.Comment != "uploader 2.1" {
+		t.Errorf("entry gzip header %+v", metadata)
+	}
+}
+
+func TestURLEncodedItemValue(t *testing.T) {
+	output := captureOutput(t)
+
+	response := postForm(display, url.Values{"item": {url.QueryEscape(`{"id":"legacy-1","type":"x"}`)}})
+	if response.Code != http.StatusOK {
+		t.Fatalf("status %d, want %d", response.Code, http.StatusOK)
+	}
+
+	if !strings.Contains(output.String(), "# URL-decoded item value\n") {
+		t.Errorf("URL-decoding not logged:\n%s", output)
+	}
+
+	if items := lastEntry(t).Values["item"]; len(items) != 1 || items[0]["id"] != "legacy-1" || items[0]["type"] != "x" {
+		t.Errorf("URL-encoded item decoded to %v", items)
+	}
+
+	postForm(display, url.Values{"item": {`{"id":"plain 100%"}`}})
+
+	if items := lastEntry(t).Values["item"]; len(items) != 1 || items[0]["id"] != "plain 100%" {
+		t.Errorf("plain item decoded to %v", items)
+	}
+}
+
+func TestItemArray(t *testing.T) {
+	first := base64.StdEncoding.EncodeToString([]byte("first"))
+	second := base64.StdEncoding.EncodeToString([]byte("second"))
+
+	postForm(display, url.Values{"item": {`[{"id":"1","data":"` + first + `"},{"id":"2","data":"` + second + `"}]`}})
+
+	items := lastEntry(t).Values["item"]
+	if len(items) != 2 || items[0]["id"] != "1" || items[0]["data"] != "first" || items[1]["id"] != "2" || items[1]["data"] != "second" {
+		t.Errorf("array of objects decoded to %v", items)
+	}
+}
+
+func TestItemArrayMixedWithObjects(t *testing.T) {
+	postForm(display, url.Values{"item": {`{"id":"legacy"}`, `[{"id":"new-1"},null,{"id":"new-2"}]`}})
+
+	var ids []string
+	for _, item := range lastEntry(t).Values["item"] {
+		ids = append(ids, item["id"])
+	}
+
+	if strings.Join(ids, ",") != "legacy,new-1,new-2" {
+		t.Errorf("mixed item values decoded to ids %v", ids)
+	}
+
+	if errors := lastEntry(t).Errors; len(errors) != 0 {
+		t.Errorf("entry has errors %v", errors)
+	}
+
+	postForm(display, url.Values{"item": {`[{"id":"1"},"not an object"]`}})
+
+	if errors := lastEntry(t).Errors; len(errors) != 1 || !strings.HasPrefix(errors[0], "decoding json:") {
+		t.Errorf("array with a non-object gave errors %v", errors)
+	}
+}
+
+func TestItemEmptyArray(t *testing.T) {
+	response := postForm(display, url.Values{"item": {`[]`}})
+	if response.Code != http.StatusOK {
+		t.Errorf("status %d, want %d", response.Code, http.StatusOK)
+	}
+
+	entry := lastEntry(t)
+	if len(entry.Values["item"]) != 0 || len(entry.Errors) != 0 {
+		t.Errorf("empty array decoded to %v with errors %v", entry.Values["item"], entry.Errors)
+	}
+}
+
+func TestOnRequest(t *testing.T) {
+	var received []RequestEntry
+	remove := datastore.OnRequest(func(entry RequestEntry) {
+		received = append(received, entry)
+	})
+
+	postForm(display, url.Values{"item": {`{"id":"hooked"}`}})
+	remove()
+	postForm(display, url.Values{"item": {`{"id":"after removal"}`}})
+
+	if len(received) != 1 {
+		t.Fatalf("callback called %d times, want 1", len(received))
+	}
+
+	if entry := received[0]; entry.Status != http.StatusOK || len(entry.Values["item"]) != 1 || entry.Values["item"][0]["id"] != "hooked" {
+		t.Errorf("callback got status %d and items %v", entry.Status, entry.Values["item"])
+	}
+}
+
+func TestOnRequestGetsACopy(t *testing.T) {
+	var remove func()
+	remove = datastore.OnRequest(func(entry RequestEntry) {
+		entry.Values["item"][0]["id"] = "changed"
+		entry.Header["X-Changed"] = []string{"yes"}
+
+		// Removing itself mustn't deadlock.
+		remove()
+	})
+	defer remove()
+
+	postForm(display, url.Values{"item": {`{"id":"original"}`}})
+
+	entry := lastEntry(t)
+	if entry.Values["item"][0]["id"] != "original" || entry.Header["X-Changed"] != nil {
+		t.Errorf("callback changed the remembered entry: %v %v", entry.Values["item"], entry.Header)
+	}
+}
+
+func TestOnRequestAfterResponse(t *testing.T) {
+	setFlag(t, "gzip-responses", "true")
+
+	response := httptest.NewRecorder()
+	var complete bool
+	remove := datastore.OnRequest(func(entry RequestEntry) {
+		_, err := decompress(response.Body.Bytes())
+		complete = err == nil
+	})
+	defer remove()
+
+	display(response, dataFileRequest("/datastore", gzipped([]byte("{}"))))
+
+	if !complete {
+		t.Errorf("callback ran before the gzipped response was finished")
+	}
+
+	timeout := callbacksAfter(http.TimeoutHandler(http.HandlerFunc(display), time.Minute, "timed out").ServeHTTP)
+
+	response = httptest.NewRecorder()
+	complete = false
+	timeout(response, dataFileRequest("/datastore", gzipped([]byte("{}"))))
+
+	if !complete {
+		t.Errorf("callback ran before -request-timeout sent the response")
+	}
+}
+
+func TestAdminResponsesAppendNewline(t *testing.T) {
+	setFlag(t, "append-newline", "true")
+
+	for path, handler := range map[string]http.HandlerFunc{"/config": showConfig, "/admin/faults": adminFaults} {
+		response := httptest.NewRecorder()
+		handler(response, httptest.NewRequest(http.MethodGet, path, nil))
+
+		if !strings.HasSuffix(response.Body.String(), "}\n") {
+			t.Errorf("%s body %q doesn't end with a newline", path, response.Body)
+		}
+	}
+}
+
+func TestStoreFieldsDataFile(t *testing.T) {
+	previous := storeFields
+	defer func() {
+		storeFields = previous
+	}()
+
+	entry := &RequestEntry{Files: []FileEntry{{Field: "dataFile", Data: "contents"}}}
+
+	for value, want := range map[string]string{"datafile": "contents", "files": "", "items,datafile": "contents"} {
+		fields, err := parseStoreFields(value)
+		if err != nil {
+			t.Fatalf("-store-fields %s: %s", value, err)
+		}
+		storeFields = fields
+
+		base := t.TempDir() + "/1"
+		err = storeEntry(base, entry)
+		if err != nil {
+			t.Fatalf("-store-fields %s: storing: %s", value, err)
+		}
+
+		data, _ := ioutil.ReadFile(base + ".entry.json")
+		var stored struct {
+			Files []FileEntry `json:"files"`
+		}
+		json.Unmarshal(data, &stored)
+
+		if len(stored.Files) != 1 || stored.Files[0].Data != want {
+			t.Errorf("-store-fields %s stored files %+v, want data %q", value, stored.Files, want)
+		}
+	}
+}
+
+func TestFinishedJobsExpire(t *testing.T) {
+	setFlag(t, "job-ttl", "500ms")
+
+	response := postForm(acceptAsync(display), url.Values{"item": {`{"id":"1"}`}})
+	id := decodeResponse(t, response.Body.Bytes())["job_id"].(string)
+
+	poll := func() int {
+		response := httptest.NewRecorder()
+		showJob(response, httptest.NewRequest(http.MethodGet, "/jobs/"+id, nil))
+		return response.Code
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		jobsLock.Lock()
+		status := jobs[id].Status
+		jobsLock.Unlock()
+
+		if status != "pending" {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("job still pending")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if code := poll(); code != http.StatusOK {
+		t.Errorf("finished job polled with status %d, want %d", code, http.StatusOK)
+	}
+
+	time.Sleep(time.Second)
+
+	if code := poll(); code != http.StatusNotFound {
+		t.Errorf("expired job polled with status %d, want %d", code, http.StatusNotFound)
+	}
+}
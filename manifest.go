@@ -0,0 +1,127 @@
+package main
+
+import "bufio"
+import "crypto/sha256"
+import "encoding/hex"
+import "encoding/json"
+import "net/http"
+import "os"
+import "sort"
+import "strings"
+import "sync"
+
+// A file of the item ids, or sha256 hashes of item data, a test expects to be uploaded.
+var MANIFESTFILE string
+var MANIFESTKEY string
+
+// The expected ids from -manifest, and everything received so far with the number of
+// items it was seen in.
+var manifest = make(map[string]bool)
+var manifestReceived = make(map[string]int)
+var manifestLock sync.Mutex
+
+// Read one id or hash per line, skipping blank lines and # comments.
+func loadManifest(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		manifest[line] = true
+	}
+
+	return scanner.Err()
+}
+
+// The name of an item in manifest terms: its -manifest-key field if the manifest lists
+// it, otherwise the sha256 of its data if that's listed, otherwise whichever it has.
+func manifestName(item map[string]string) string {
+	id := item[MANIFESTKEY]
+	if id != "" && manifest[id] {
+		return id
+	}
+
+	var hash string
+	if data, ok := item["data"]; ok {
+		sum := sha256.Sum256([]byte(data))
+		hash = hex.EncodeToString(sum[:])
+		if manifest[hash] {
+			return hash
+		}
+	}
+
+	if id != "" {
+		return id
+	}
+
+	return hash
+}
+
+// Note the items of a finished request against -manifest.
+func checkManifest(entry *RequestEntry) {
+	manifestLock.Lock()
+	defer manifestLock.Unlock()
+
+	for _, key := range []string{"item", "body"} {
+		for _, item := range entry.Values[key] {
+			if name := manifestName(item); name != "" {
+				manifestReceived[name]++
+			}
+		}
+	}
+}
+
+// GET /manifest/status, the -manifest entries received and missing, and anything
+// received that the manifest doesn't list.
+func manifestStatus(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		respondError(writer, http.StatusMethodNotAllowed, "only GET is supported")
+		return
+	}
+
+	received := []string{}
+	missing := []string{}
+	unexpected := []string{}
+
+	manifestLock.Lock()
+	for name := range manifest {
+		if manifestReceived[name] > 0 {
+			received = append(received, name)
+		} else {
+			missing = append(missing, name)
+		}
+	}
+
+	for name := range manifestReceived {
+		if !manifest[name] {
+			unexpected = append(unexpected, name)
+		}
+	}
+	manifestLock.Unlock()
+
+	sort.Strings(received)
+	sort.Strings(missing)
+	sort.Strings(unexpected)
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"complete":         len(missing) == 0,
+		"expected_count":   len(manifest),
+		"received_count":   len(received),
+		"missing_count":    len(missing),
+		"unexpected_count": len(unexpected),
+		"received":         received,
+		"missing":          missing,
+		"unexpected":       unexpected,
+	})
+
+	writer.Header().Set("Content-Type", "application/json")
+	writeLine(writer, body)
+}
@@ -0,0 +1,304 @@
+package main
+
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "math"
+import "time"
+
+// How base64 'data' values are interpreted once decoded: raw or msgpack.
+var DATAFORMAT string
+
+var errMsgpackShort = errors.New("unexpected end of msgpack data")
+
+// Decode a single MessagePack value into values encoding/json can marshal.  Maps with
+// non-string keys get their keys formatted with %v, timestamps become RFC 3339 strings,
+// NaN and the infinities become "NaN", "Infinity" and "-Infinity", and other ext values
+// become {"type", "data"}.
+func decodeMsgpack(data []byte) (interface{}, error) {
+	decoder := &msgpackDecoder{data: data}
+
+	value, err := decoder.value()
+	if err != nil {
+		return nil, err
+	}
+
+	if decoder.offset != len(data) {
+		return nil, fmt.Errorf("%d bytes of msgpack data left over", len(data)-decoder.offset)
+	}
+
+	return value, nil
+}
+
+type msgpackDecoder struct {
+	data   []byte
+	offset int
+
+	// Arrays and maps currently open.  The result becomes json, so nesting is held to
+	// -max-json-depth, which also keeps a run of array headers from exhausting the stack.
+	depth int
+}
+
+func (decoder *msgpackDecoder) enter() error {
+	decoder.depth++
+	if decoder.depth > MAXJSONDEPTH {
+		return fmt.Errorf("msgpack nests deeper than %d levels", MAXJSONDEPTH)
+	}
+
+	return nil
+}
+
+func (decoder *msgpackDecoder) next(count int) ([]byte, error) {
+	if count < 0 || len(decoder.data)-decoder.offset < count {
+		return nil, errMsgpackShort
+	}
+
+	bytes := decoder.data[decoder.offset : decoder.offset+count]
+	decoder.offset += count
+
+	return bytes, nil
+}
+
+// Read a big endian unsigned integer of size bytes.
+func (decoder *msgpackDecoder) uint(size int) (uint64, error) {
+	bytes, err := decoder.next(size)
+	if err != nil {
+		return 0, err
+	}
+
+	switch size {
+	case 1:
+		return uint64(bytes[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(bytes)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(bytes)), nil
+	}
+
+	return binary.BigEndian.Uint64(bytes), nil
+}
+
+func (decoder *msgpackDecoder) int(size int) (int64, error) {
+	value, err := decoder.uint(size)
+
+	switch size {
+	case 1:
+		return int64(int8(value)), err
+	case 2:
+		return int64(int16(value)), err
+	case 4:
+		return int64(int32(value)), err
+	}
+
+	return int64(value), err
+}
+
+// Read a length of size bytes followed by that many bytes.
+func (decoder *msgpackDecoder) sized(size int) ([]byte, error) {
+	length, err := decoder.uint(size)
+	if err != nil {
+		return nil, err
+	}
+
+	if length > uint64(len(decoder.data)) {
+		return nil, errMsgpackShort
+	}
+
+	return decoder.next(int(length))
+}
+
+func (decoder *msgpackDecoder) value() (interface{}, error) {
+	header, err := decoder.next(1)
+	if err != nil {
+		return nil, err
+	}
+
+	code := header[0]
+
+	switch {
+	case code <= 0x7f:
+		return int64(code), nil
+	case code >= 0xe0:
+		return int64(int8(code)), nil
+	case code&0xf0 == 0x80:
+		return decoder.mapOf(int(code & 0x0f))
+	case code&0xf0 == 0x90:
+		return decoder.arrayOf(int(code & 0x0f))
+	case code&0xe0 == 0xa0:
+		bytes, err := decoder.next(int(code & 0x1f))
+		return string(bytes), err
+	}
+
+	switch code {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+
+	case 0xc4, 0xc5, 0xc6:
+		return decoder.sized(1 << (code - 0xc4))
+
+	case 0xc7, 0xc8, 0xc9:
+		length, err := decoder.uint(1 << (code - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+
+		return decoder.ext(int(length))
+
+	case 0xca:
+		bits, err := decoder.uint(4)
+		return jsonFloat(float64(math.Float32frombits(uint32(bits)))), err
+	case 0xcb:
+		bits, err := decoder.uint(8)
+		return jsonFloat(math.Float64frombits(bits)), err
+
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return decoder.uint(1 << (code - 0xcc))
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		return decoder.int(1 << (code - 0xd0))
+
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return decoder.ext(1 << (code - 0xd4))
+
+	case 0xd9, 0xda, 0xdb:
+		bytes, err := decoder.sized(1 << (code - 0xd9))
+		return string(bytes), err
+
+	case 0xdc, 0xdd:
+		length, err := decoder.uint(2 << (code - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+
+		return decoder.arrayOf(int(length))
+
+	case 0xde, 0xdf:
+		length, err := decoder.uint(2 << (code - 0xde))
+		if err != nil {
+			return nil, err
+		}
+
+		return decoder.mapOf(int(length))
+	}
+
+	return nil, fmt.Errorf("unknown msgpack type 0x%02x", code)
+}
+
+func (decoder *msgpackDecoder) ext(length int) (interface{}, error) {
+	kind, err := decoder.int(1)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := decoder.next(length)
+	if err != nil {
+		return nil, err
+	}
+
+	if kind == -1 {
+		return msgpackTimestamp(data)
+	}
+
+	return map[string]interface{}{"type": kind, "data": data}, nil
+}
+
+// The timestamp extension, type -1, in its 32, 64 and 96 bit forms.
+func msgpackTimestamp(data []byte) (interface{}, error) {
+	var seconds, nanoseconds int64
+
+	switch len(data) {
+	case 4:
+		seconds = int64(binary.BigEndian.Uint32(data))
+	case 8:
+		packed := binary.BigEndian.Uint64(data)
+		nanoseconds = int64(packed >> 34)
+		seconds = int64(packed & (1<<34 - 1))
+	case 12:
+		nanoseconds = int64(binary.BigEndian.Uint32(data))
+		seconds = int64(binary.BigEndian.Uint64(data[4:]))
+	default:
+		return nil, fmt.Errorf("msgpack timestamp of %d bytes", len(data))
+	}
+
+	if nanoseconds > 999999999 {
+		return nil, fmt.Errorf("msgpack timestamp with %d nanoseconds", nanoseconds)
+	}
+
+	return time.Unix(seconds, nanoseconds).UTC().Format(time.RFC3339Nano), nil
+}
+
+func (decoder *msgpackDecoder) arrayOf(length int) (interface{}, error) {
+	if length > len(decoder.data) {
+		return nil, errMsgpackShort
+	}
+
+	err := decoder.enter()
+	defer func() { decoder.depth-- }()
+	if err != nil {
+		return nil, err
+	}
+
+	array := make([]interface{}, 0, length)
+	for index := 0; index < length; index++ {
+		element, err := decoder.value()
+		if err != nil {
+			return nil, err
+		}
+
+		array = append(array, element)
+	}
+
+	return array, nil
+}
+
+func (decoder *msgpackDecoder) mapOf(length int) (interface{}, error) {
+	if length > len(decoder.data) {
+		return nil, errMsgpackShort
+	}
+
+	err := decoder.enter()
+	defer func() { decoder.depth-- }()
+	if err != nil {
+		return nil, err
+	}
+
+	object := make(map[string]interface{}, length)
+	for index := 0; index < length; index++ {
+		key, err := decoder.value()
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := decoder.value()
+		if err != nil {
+			return nil, err
+		}
+
+		name, ok := key.(string)
+		if !ok {
+			name = fmt.Sprint(key)
+		}
+
+		object[name] = value
+	}
+
+	return object, nil
+}
+
+// encoding/json can't marshal NaN or the infinities, so they're shown as the strings
+// protobuf's json mapping uses.
+func jsonFloat(value float64) interface{} {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "Infinity"
+	case math.IsInf(value, -1):
+		return "-Infinity"
+	}
+
+	return value
+}
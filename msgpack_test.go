@@ -0,0 +1,84 @@
+package main
+
+import "bytes"
+import "strings"
+import "testing"
+
+func TestMsgpackDepthLimit(t *testing.T) {
+	// A million nested one element arrays around a nil.
+	data := append(bytes.Repeat([]byte{0x91}, 1000000), 0xc0)
+
+	_, err := decodeMsgpack(data)
+	if err == nil || !strings.Contains(err.Error(), "nests deeper") {
+		t.Errorf("deeply nested msgpack gave %v, want a nesting error", err)
+	}
+}
+
+func TestMsgpackNestingWithinLimit(t *testing.T) {
+	data := append(bytes.Repeat([]byte{0x91}, MAXJSONDEPTH), 0xc0)
+
+	_, err := decodeMsgpack(data)
+	if err != nil {
+		t.Errorf("msgpack nested %d deep: %s", MAXJSONDEPTH, err)
+	}
+}
+
+func TestMsgpackTruncated(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"array missing elements": {0x92, 0x01},
+		"map missing a value":    {0x81, 0xa1, 'k'},
+		"short str8":             {0xd9, 0x05, 'a', 'b'},
+		"short uint32":           {0xce, 0x01, 0x02},
+		"array16 with no length": {0xdc},
+		"empty":                  {},
+	} {
+		_, err := decodeMsgpack(data)
+		if err != errMsgpackShort {
+			t.Errorf("%s: got %v, want %v", name, err, errMsgpackShort)
+		}
+	}
+}
+
+func TestMsgpackNonFiniteFloats(t *testing.T) {
+	for name, test := range map[string]struct {
+		data []byte
+		want string
+	}{
+		"float64 NaN":     {[]byte{0xcb, 0x7f, 0xf8, 0, 0, 0, 0, 0, 0}, `"NaN"`},
+		"float64 +Inf":    {[]byte{0xcb, 0x7f, 0xf0, 0, 0, 0, 0, 0, 0}, `"Infinity"`},
+		"float32 -Inf":    {[]byte{0xca, 0xff, 0x80, 0, 0}, `"-Infinity"`},
+		"float32 1.5":     {[]byte{0xca, 0x3f, 0xc0, 0, 0}, `1.5`},
+		"NaN in an array": {[]byte{0x92, 0x01, 0xca, 0x7f, 0xc0, 0, 0}, `[1,"NaN"]`},
+	} {
+		shown, err := msgpackToJSON(test.data)
+		if err != nil || string(shown) != test.want {
+			t.Errorf("%s: got %s (%v), want %s", name, shown, err, test.want)
+		}
+	}
+}
+
+func TestMsgpackTimestamp(t *testing.T) {
+	for name, test := range map[string]struct {
+		data []byte
+		want string
+	}{
+		"32 bit": {[]byte{0xd6, 0xff, 0x5f, 0x5e, 0x10, 0x00}, `"2020-09-13T12:26:40Z"`},
+		"64 bit": {[]byte{0xd7, 0xff, 0x00, 0x00, 0x00, 0x04, 0x5f, 0x5e, 0x10, 0x00}, `"2020-09-13T12:26:40.000000001Z"`},
+		"96 bit": {append([]byte{0xc7, 12, 0xff, 0, 0, 0, 0}, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff), `"1969-12-31T23:59:59Z"`},
+	} {
+		shown, err := msgpackToJSON(test.data)
+		if err != nil || string(shown) != test.want {
+			t.Errorf("%s: got %s (%v), want %s", name, shown, err, test.want)
+		}
+	}
+
+	_, err := decodeMsgpack([]byte{0xd5, 0xff, 0x00, 0x01})
+	if err == nil {
+		t.Errorf("a 2 byte timestamp decoded without an error")
+	}
+
+	shown, _ := msgpackToJSON([]byte{0xd4, 0x05, 0x2a})
+	if string(shown) != `{"data":"Kg==","type":5}` {
+		t.Errorf("other ext shown as %s", shown)
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "mime"
+import "mime/multipart"
+import "strings"
+import "time"
+
+var GZIPBYCONTENTTYPE bool
+
+// Comma separated multipart field names every upload has to include.
+var REQUIREFIELDS string
+
+// Process each part of a multipart body as it arrives, so whatever was received is still
+// shown if the client goes away mid-upload.  Returns the reason to reject the request
+// under -strict, if any.
+func displayMultipart(reader *multipart.Reader, entry *RequestEntry) string {
+	var rejection string
+
+	complete := 0
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return rejection
+		}
+
+		if err == nil {
+			fmt.Fprintf(&entry.output, "# part %s\n", describePart(part))
+			printHeaders(&entry.output, part.Header)
+
+			var reason string
+			if part.FileName() != "" {
+				reason, err = displayFilePart(part, entry)
+			} else {
+				err = displayValuePart(part, entry)
+			}
+
+			if reason != "" {
+				rejection = reason
+			}
+
+			if err == nil {
+				complete++
+			}
+		}
+
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			fmt.Fprintf(&entry.output, "# client disconnected during upload, %d parts complete\n", complete)
+			entry.Errors = append(entry.Errors, "client disconnected during upload")
+			return rejection
+		}
+
+		if err != nil {
+			entry.logError("reading multipart body: %s", err)
+			return rejection
+		}
+	}
+}
+
+func describePart(part *multipart.Part) string {
+	if part.FileName() != "" {
+		return fmt.Sprintf("%s, file %s", part.FormName(), part.FileName())
+	}
+
+	return part.FormName()
+}
+
+func displayValuePart(part *multipart.Part, entry *RequestEntry) error {
+	value, err := ioutil.ReadAll(part)
+	if err != nil {
+		return err
+	}
+
+	value = transcodePart(&entry.output, part.Header.Get("Content-Type"), value)
+
+	displayValues(map[string][]string{part.FormName(): {string(value)}}, entry)
+
+	return nil
+}
+
+// Show a file part, gunzipping dataFile.  Returns the reason to reject the request under
+// -strict, if any, and any error reading the part itself.
+func displayFilePart(part *multipart.Part, entry *RequestEntry) (string, error) {
+	field := part.FormName()
+	declared := part.Header.Get(CONTENTSHA256)
+	hasher := newPartHasher(part, declared)
+	counter := &countingReader{ReadCloser: hasher}
+	gzipped := gzipPart(part)
+
+	var data []byte
+	var decoded []byte
+	var reason string
+	var metadata *GzipHeader
+
+	if !RAW && gzipped && SAMPLE {
+		start := time.Now()
+		sample, total, header, err := sampleGzip(counter)
+		entry.addStage("gzip", time.Since(start)-counter.elapsed)
+		if counter.err != nil {
+			return "", counter.err
+		}
+
+		fmt.Fprintf(&entry.output, "# read %d bytes\n", counter.count)
+
+		if err != nil && counter.count == 0 {
+			reason = emptyPart(field, entry)
+		} else if err != nil {
+			return logDecompressError(err, entry), nil
+		} else {
+			fmt.Fprintf(&entry.output, "# dataFile: sampled %d of %d decompressed bytes\n", len(sample), total)
+			entry.DataFileBytes += int(total)
+			data = sample
+			metadata = header
+		}
+	} else {
+		raw, err := ioutil.ReadAll(counter)
+		if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(&entry.output, "# read %d bytes\n", counter.count)
+
+		data = raw
+		if GZIPBYCONTENTTYPE && len(raw) > 1 && raw[0] == 0x1f && raw[1] == 0x8b {
+			gzipped = true
+		}
+
+		if len(raw) == 0 {
+			reason = emptyPart(field, entry)
+		} else if !RAW && gzipped {
+			metadata = readGzipHeader(raw)
+			data, decoded, reason = decodeDataFile(raw, entry)
+			if data == nil {
+				return reason, nil
+			}
+		}
+	}
+
+	showGzipHeader(&entry.output, metadata)
+
+	data = transcodePart(&entry.output, part.Header.Get("Content-Type"), data)
+	if !gzipped {
+		entry.keepDecoded(field, data)
+		data = redactBody(field, data)
+	}
+
+	file := FileEntry{
+		Field:    field,
+		Filename: part.FileName(),
+		Size:     counter.count,
+		Header:   redact(part.Header),
+		Data:     string(data),
+		Gzip:     metadata,
+	}
+	checkPartHashes(&entry.output, hasher, declared, decoded, &file)
+	entry.Files = append(entry.Files, file)
+
+	fmt.Fprintf(&entry.output, "#\t%s:\n%s\n", field, data)
+
+	return reason, nil
+}
+
+// Whether a file part holds gzip data: the dataFile field, or with -gzip-by-content-type
+// any part declared as application/gzip or application/x-gzip.  Parts that start with the
+// gzip magic bytes are also decompressed under -gzip-by-content-type, once read.
+func gzipPart(part *multipart.Part) bool {
+	if !GZIPBYCONTENTTYPE {
+		return part.FormName() == "dataFile"
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+
+	return mediaType == "application/gzip" || mediaType == "application/x-gzip"
+}
+
+// Describe what's wrong with a multipart Content-Type's boundary, or "" if it's fine or
+// the type isn't multipart.
+func boundaryProblem(contentType string) string {
+	kind, _, _ := strings.Cut(contentType, "/")
+	if !strings.EqualFold(strings.TrimSpace(kind), "multipart") {
+		return ""
+	}
+
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Sprintf("malformed multipart Content-Type: %s", err)
+	}
+
+	boundary, ok := params["boundary"]
+	if !ok {
+		return "multipart Content-Type missing boundary"
+	}
+
+	if len(boundary) == 0 || len(boundary) > 70 || strings.HasSuffix(boundary, " ") {
+		return "multipart boundary must be 1 to 70 characters, not ending in a space"
+	}
+
+	for _, char := range boundary {
+		if !strings.ContainsRune("0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ'()+_,-./:=? ", char) {
+			return fmt.Sprintf("invalid character %q in multipart boundary", char)
+		}
+	}
+
+	return ""
+}
+
+func requiredFields() []string {
+	var names []string
+	for _, name := range strings.Split(REQUIREFIELDS, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// Note a zero byte file part, which is left undecoded.  Returns the reason to reject the
+// request under -strict if it's one of -require-fields.
+func emptyPart(field string, entry *RequestEntry) string {
+	fmt.Fprintf(&entry.output, "# WARNING: empty part '%s'\n", field)
+
+	for _, name := range requiredFields() {
+		if name == field {
+			entry.Errors = append(entry.Errors, "empty required field "+field)
+			return "empty required field " + field
+		}
+	}
+
+	return ""
+}
+
+// The -require-fields names with neither a value nor a file part in the entry.
+func missingFields(entry *RequestEntry) []string {
+	if REQUIREFIELDS == "" {
+		return nil
+	}
+
+	present := make(map[string]bool)
+	for key := range entry.Values {
+		present[key] = true
+	}
+
+	for _, file := range entry.Files {
+		present[file.Field] = true
+	}
+
+	var missing []string
+	for _, name := range requiredFields() {
+		if !present[name] {
+			missing = append(missing, name)
+		}
+	}
+
+	return missing
+}
@@ -0,0 +1,24 @@
+package main
+
+import "fmt"
+import "io/ioutil"
+import "os"
+import "strconv"
+import "strings"
+
+var PIDFILE string
+var FORCE bool
+
+// Write the process id to -pid-file, refusing if the file names a process that's still
+// running, unless -force is given.
+func writePIDFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err == nil && !FORCE {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err == nil && pid > 0 && processRunning(pid) {
+			return fmt.Errorf("%s names running process %d, use -force to start anyway", path, pid)
+		}
+	}
+
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
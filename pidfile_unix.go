@@ -0,0 +1,12 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// Returns whether a process with the given id exists.
+func processRunning(pid int) bool {
+	err := syscall.Kill(pid, 0)
+
+	return err == nil || err == syscall.EPERM
+}
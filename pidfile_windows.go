@@ -0,0 +1,15 @@
+package main
+
+import "os"
+
+// Returns whether a process with the given id exists.  FindProcess opens the process on
+// Windows, so it fails once the process has gone.
+func processRunning(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+
+	return true
+}
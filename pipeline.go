@@ -0,0 +1,128 @@
+package main
+
+import "encoding/base64"
+import "encoding/json"
+import "fmt"
+import "io"
+import "strings"
+import "time"
+
+// The transforms applied in order to base64 'data' values, names from TRANSFORMS.  When
+// empty it is base64, followed by msgpack under -data-format=msgpack.
+var PIPELINE string
+
+var pipeline []string
+
+// A named decode step.  Stage is the timing stage its time is counted under, if any.
+// Notes about the decoding go to output.
+type transform struct {
+	stage string
+	apply func(output io.Writer, data []byte) ([]byte, error)
+}
+
+var TRANSFORMS = map[string]transform{
+	"base64":  {"base64", decodeBase64Layers},
+	"gunzip":  {"gzip", quietly(decompress)},
+	"json":    {"json", quietly(checkJSON)},
+	"msgpack": {"", quietly(msgpackToJSON)},
+}
+
+// A transform for a decoder with nothing to note.
+func quietly(decode func(data []byte) ([]byte, error)) func(io.Writer, []byte) ([]byte, error) {
+	return func(output io.Writer, data []byte) ([]byte, error) {
+		return decode(data)
+	}
+}
+
+// Parse -pipeline, failing on unknown transform names.
+func parsePipeline(value string) ([]string, error) {
+	if value == "" {
+		if DATAFORMAT == "msgpack" {
+			return []string{"base64", "msgpack"}, nil
+		}
+
+		return []string{"base64"}, nil
+	}
+
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if _, ok := TRANSFORMS[name]; !ok {
+			return nil, fmt.Errorf("unknown transform %q", name)
+		}
+
+		names = append(names, name)
+	}
+
+	return names, nil
+}
+
+// Run data through the pipeline, stopping at the first transform that fails.
+func runPipeline(data []byte, entry *RequestEntry) ([]byte, error) {
+	for _, name := range pipeline {
+		step := TRANSFORMS[name]
+
+		start := time.Now()
+		decoded, err := step.apply(&entry.output, data)
+		if step.stage != "" {
+			entry.timeStage(step.stage, start)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("decoding %s data: %s", name, err)
+		}
+
+		fmt.Fprintf(&entry.output, "# Decoded %s data\n", name)
+		data = decoded
+	}
+
+	return data, nil
+}
+
+// Decode base64, allowing whitespace separated chunks, then peel further layers while
+// the result still decodes, for -base64-depth.
+func decodeBase64Layers(output io.Writer, data []byte) ([]byte, error) {
+	encoded := string(data)
+
+	decoded, err := base64.StdEncoding.DecodeString(stripSpace(encoded))
+	if err != nil && len(strings.Fields(encoded)) > 1 {
+		decoded, err = decodeChunks(encoded)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	layers := 1
+	for ; layers < BASE64DEPTH && len(decoded) > 0; layers++ {
+		inner, err := base64.StdEncoding.DecodeString(stripSpace(string(decoded)))
+		if err != nil {
+			break
+		}
+
+		decoded = inner
+	}
+
+	if layers > 1 {
+		fmt.Fprintf(output, "# Peeled %d layers of base64 data\n", layers)
+	}
+
+	return decoded, nil
+}
+
+func checkJSON(data []byte) ([]byte, error) {
+	if err := json.Unmarshal(data, new(json.RawMessage)); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func msgpackToJSON(data []byte) ([]byte, error) {
+	value, err := decodeMsgpack(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(value)
+}
@@ -0,0 +1,27 @@
+package main
+
+import "bytes"
+import "encoding/base64"
+import "io/ioutil"
+import "testing"
+
+func TestBase64Chunks(t *testing.T) {
+	want := []byte("first chunk, second chunk")
+
+	// MIME style line breaks inside one encoding, and chunks each padded separately.
+	wrapped := base64.StdEncoding.EncodeToString(want)
+	wrapped = wrapped[:8] + "\r\n" + wrapped[8:16] + "\n" + wrapped[16:]
+	padded := base64.StdEncoding.EncodeToString(want[:13]) + "\n" + base64.StdEncoding.EncodeToString(want[13:])
+
+	for name, encoded := range map[string]string{"wrapped": wrapped, "padded chunks": padded} {
+		decoded, err := decodeBase64Layers(ioutil.Discard, []byte(encoded))
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+
+		if !bytes.Equal(decoded, want) {
+			t.Errorf("%s: decoded %q, want %q", name, decoded, want)
+		}
+	}
+}
@@ -0,0 +1,551 @@
+package main
+
+import "encoding/binary"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io/ioutil"
+import "math"
+import "strconv"
+import "strings"
+
+// A compiled FileDescriptorSet (protoc --descriptor_set_out) and the message type in it a
+// dataFile holds.  With both, decoded dataFiles are parsed as that message and shown as json.
+var PROTODESCRIPTOR string
+var PROTOMESSAGE string
+
+// The -proto-message type, nil unless dataFiles are protobuf, and every message and enum
+// type in the descriptor set by fully qualified name.
+var protoType *protoMessage
+var protoMessages map[string]*protoMessage
+var protoEnums map[string]map[int32]string
+
+var errProtoShort = errors.New("unexpected end of protobuf data")
+
+// Field types from descriptor.proto's FieldDescriptorProto.Type.
+const (
+	protoDouble   = 1
+	protoFloat    = 2
+	protoInt64    = 3
+	protoUint64   = 4
+	protoInt32    = 5
+	protoFixed64  = 6
+	protoFixed32  = 7
+	protoBool     = 8
+	protoString   = 9
+	protoGroup    = 10
+	protoNested   = 11
+	protoBytes    = 12
+	protoUint32   = 13
+	protoEnum     = 14
+	protoSfixed32 = 15
+	protoSfixed64 = 16
+	protoSint32   = 17
+	protoSint64   = 18
+)
+
+// The parts of a DescriptorProto needed to decode its messages.
+type protoMessage struct {
+	name   string
+	fields map[uint64]*protoField
+
+	// Whether this is the key and value entry protoc generates for a map field.
+	mapEntry bool
+}
+
+type protoField struct {
+	name     string
+	jsonName string
+	number   uint64
+	repeated bool
+	kind     uint64
+
+	// The fully qualified name of a message or enum field's type, like .bsg.Reading.
+	typeName string
+}
+
+type protoReader struct {
+	data   []byte
+	offset int
+}
+
+func (reader *protoReader) varint() (uint64, error) {
+	value, size := binary.Uvarint(reader.data[reader.offset:])
+	if size == 0 {
+		return 0, errProtoShort
+	}
+
+	if size < 0 {
+		return 0, errors.New("protobuf varint overflows 64 bits")
+	}
+
+	reader.offset += size
+
+	return value, nil
+}
+
+func (reader *protoReader) next(count uint64) ([]byte, error) {
+	if count > uint64(len(reader.data)-reader.offset) {
+		return nil, errProtoShort
+	}
+
+	bytes := reader.data[reader.offset : reader.offset+int(count)]
+	reader.offset += int(count)
+
+	return bytes, nil
+}
+
+// Read the next field, returning its number and wire type with either its integer value
+// or, for a length delimited field, its bytes.  Groups aren't supported.
+func (reader *protoReader) field() (uint64, uint64, uint64, []byte, error) {
+	key, err := reader.varint()
+	if err != nil {
+		return 0, 0, 0, nil, err
+	}
+
+	number, wireType := key>>3, key&7
+	if number == 0 {
+		return 0, 0, 0, nil, errors.New("protobuf field number 0")
+	}
+
+	var value uint64
+	var bytes []byte
+
+	switch wireType {
+	case 0:
+		value, err = reader.varint()
+	case 1:
+		bytes, err = reader.next(8)
+		if err == nil {
+			value, bytes = binary.LittleEndian.Uint64(bytes), nil
+		}
+	case 2:
+		value, err = reader.varint()
+		if err == nil {
+			bytes, err = reader.next(value)
+		}
+	case 5:
+		bytes, err = reader.next(4)
+		if err == nil {
+			value, bytes = uint64(binary.LittleEndian.Uint32(bytes)), nil
+		}
+	default:
+		err = fmt.Errorf("unsupported protobuf wire type %d", wireType)
+	}
+
+	return number, wireType, value, bytes, err
+}
+
+// Call found with each field of a message, stopping at the first error.
+func eachProtoField(data []byte, found func(number, value uint64, bytes []byte) error) error {
+	reader := &protoReader{data: data}
+
+	for reader.offset < len(data) {
+		number, _, value, bytes, err := reader.field()
+		if err == nil {
+			err = found(number, value, bytes)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Read the -proto-descriptor FileDescriptorSet and find message in it.
+func loadProtoDescriptor(path, message string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	protoMessages = make(map[string]*protoMessage)
+	protoEnums = make(map[string]map[int32]string)
+
+	err = eachProtoField(data, func(number, _ uint64, bytes []byte) error {
+		if number == 1 {
+			return addProtoFile(bytes)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("%s isn't a FileDescriptorSet: %s", path, err)
+	}
+
+	protoType = protoMessages["."+strings.TrimPrefix(message, ".")]
+	if protoType == nil {
+		return fmt.Errorf("%s has no message %s", path, message)
+	}
+
+	return nil
+}
+
+// Add the message and enum types of a FileDescriptorProto.
+func addProtoFile(data []byte) error {
+	var scope string
+	var messages, enums [][]byte
+
+	err := eachProtoField(data, func(number, _ uint64, bytes []byte) error {
+		switch number {
+		case 2:
+			scope = "." + string(bytes)
+		case 4:
+			messages = append(messages, bytes)
+		case 5:
+			enums = append(enums, bytes)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, message := range messages {
+		err := addProtoMessage(scope, message)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, enum := range enums {
+		err := addProtoEnum(scope, enum)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Add a DescriptorProto declared in scope, and the types nested in it.
+func addProtoMessage(scope string, data []byte) error {
+	message := &protoMessage{fields: make(map[uint64]*protoField)}
+	var nested, enums [][]byte
+
+	err := eachProtoField(data, func(number, _ uint64, bytes []byte) error {
+		switch number {
+		case 1:
+			message.name = string(bytes)
+		case 2:
+			field, err := parseProtoField(bytes)
+			if err != nil {
+				return err
+			}
+
+			message.fields[field.number] = field
+		case 3:
+			nested = append(nested, bytes)
+		case 4:
+			enums = append(enums, bytes)
+		case 7:
+			return eachProtoField(bytes, func(number, value uint64, _ []byte) error {
+				if number == 7 {
+					message.mapEntry = value != 0
+				}
+
+				return nil
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	name := scope + "." + message.name
+	protoMessages[name] = message
+
+	for _, message := range nested {
+		err := addProtoMessage(name, message)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, enum := range enums {
+		err := addProtoEnum(name, enum)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func parseProtoField(data []byte) (*protoField, error) {
+	field := &protoField{}
+
+	err := eachProtoField(data, func(number, value uint64, bytes []byte) error {
+		switch number {
+		case 1:
+			field.name = string(bytes)
+		case 3:
+			field.number = value
+		case 4:
+			field.repeated = value == 3
+		case 5:
+			field.kind = value
+		case 6:
+			field.typeName = string(bytes)
+		case 10:
+			field.jsonName = string(bytes)
+		}
+
+		return nil
+	})
+
+	// protoc always sets json_name, but a hand-made descriptor might not.
+	if field.jsonName == "" {
+		field.jsonName = lowerCamelCase(field.name)
+	}
+
+	return field, err
+}
+
+// The json name protoc gives a field: underscores dropped, capitalising what follows.
+func lowerCamelCase(name string) string {
+	var camel strings.Builder
+
+	upper := false
+	for _, char := range name {
+		if char == '_' {
+			upper = true
+			continue
+		}
+
+		if upper && 'a' <= char && char <= 'z' {
+			char -= 'a' - 'A'
+		}
+		upper = false
+
+		camel.WriteRune(char)
+	}
+
+	return camel.String()
+}
+
+// Add an EnumDescriptorProto's value names.
+func addProtoEnum(scope string, data []byte) error {
+	var name string
+	values := make(map[int32]string)
+
+	err := eachProtoField(data, func(number, _ uint64, bytes []byte) error {
+		switch number {
+		case 1:
+			name = string(bytes)
+		case 2:
+			var valueName string
+			var valueNumber int32
+
+			err := eachProtoField(bytes, func(number, value uint64, bytes []byte) error {
+				if number == 1 {
+					valueName = string(bytes)
+				} else if number == 2 {
+					valueNumber = int32(value)
+				}
+
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			values[valueNumber] = valueName
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	protoEnums[scope+"."+name] = values
+
+	return nil
+}
+
+// A -proto-message dataFile as indented json.
+func protoToJSON(data []byte) ([]byte, error) {
+	decoded, err := decodeProto(data, protoType, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.MarshalIndent(decoded, "", "  ")
+}
+
+// Decode a message into values encoding/json can marshal, keyed by json name, following
+// protobuf's json mapping for scalars, enums, bytes, maps and nested messages.  Fields the
+// descriptor doesn't know are kept as lists of their raw values, keyed by number, where
+// protojson would drop them.  Well-known types are shown as the messages they are, not in
+// their special json forms.  Like json items, messages nest at most -max-json-depth deep.
+func decodeProto(data []byte, message *protoMessage, depth int) (map[string]interface{}, error) {
+	if depth > MAXJSONDEPTH {
+		return nil, fmt.Errorf("protobuf nests deeper than %d levels", MAXJSONDEPTH)
+	}
+
+	decoded := make(map[string]interface{})
+	reader := &protoReader{data: data}
+
+	for reader.offset < len(data) {
+		number, wireType, value, bytes, err := reader.field()
+		if err != nil {
+			return nil, err
+		}
+
+		field := message.fields[number]
+		if field == nil {
+			key := strconv.FormatUint(number, 10)
+			unknown, _ := decoded[key].([]interface{})
+
+			if bytes != nil {
+				decoded[key] = append(unknown, bytes)
+			} else {
+				decoded[key] = append(unknown, value)
+			}
+			continue
+		}
+
+		var values []interface{}
+		if expected := protoWireType(field.kind); wireType == 2 && expected != 2 && field.repeated {
+			values, err = decodePacked(bytes, field, expected)
+		} else if wireType != expected {
+			err = fmt.Errorf("wire type %d, want %d", wireType, expected)
+		} else {
+			var element interface{}
+			element, err = decodeProtoValue(field, value, bytes, depth)
+			values = []interface{}{element}
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %s", message.name, field.name, err)
+		}
+
+		if entryType := protoMessages[field.typeName]; field.kind == protoNested && entryType != nil && entryType.mapEntry {
+			entries, _ := decoded[field.jsonName].(map[string]interface{})
+			if entries == nil {
+				entries = make(map[string]interface{})
+				decoded[field.jsonName] = entries
+			}
+
+			for _, value := range values {
+				entry := value.(map[string]interface{})
+				entries[fmt.Sprint(entry["key"])] = entry["value"]
+			}
+		} else if field.repeated {
+			previous, _ := decoded[field.jsonName].([]interface{})
+			decoded[field.jsonName] = append(previous, values...)
+		} else if len(values) > 0 {
+			decoded[field.jsonName] = values[len(values)-1]
+		}
+	}
+
+	return decoded, nil
+}
+
+// The wire type a field of kind is encoded with when it isn't packed.
+func protoWireType(kind uint64) uint64 {
+	switch kind {
+	case protoDouble, protoFixed64, protoSfixed64:
+		return 1
+	case protoFloat, protoFixed32, protoSfixed32:
+		return 5
+	case protoString, protoBytes, protoNested:
+		return 2
+	case protoGroup:
+		return 3
+	}
+
+	return 0
+}
+
+// Decode the elements of a packed repeated scalar field.
+func decodePacked(data []byte, field *protoField, wireType uint64) ([]interface{}, error) {
+	var values []interface{}
+	reader := &protoReader{data: data}
+
+	for reader.offset < len(data) {
+		var value uint64
+		var err error
+
+		switch wireType {
+		case 0:
+			value, err = reader.varint()
+		case 1:
+			var bytes []byte
+			bytes, err = reader.next(8)
+			if err == nil {
+				value = binary.LittleEndian.Uint64(bytes)
+			}
+		case 5:
+			var bytes []byte
+			bytes, err = reader.next(4)
+			if err == nil {
+				value = uint64(binary.LittleEndian.Uint32(bytes))
+			}
+		default:
+			err = fmt.Errorf("can't pack protobuf type %d", field.kind)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		element, err := decodeProtoValue(field, value, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		values = append(values, element)
+	}
+
+	return values, nil
+}
+
+// Decode a single field value of the field's type from its integer value or bytes.
+func decodeProtoValue(field *protoField, value uint64, bytes []byte, depth int) (interface{}, error) {
+	switch field.kind {
+	case protoDouble:
+		return jsonFloat(math.Float64frombits(value)), nil
+	case protoFloat:
+		return jsonFloat(float64(math.Float32frombits(uint32(value)))), nil
+	case protoInt64, protoSfixed64:
+		return strconv.FormatInt(int64(value), 10), nil
+	case protoUint64, protoFixed64:
+		return strconv.FormatUint(value, 10), nil
+	case protoInt32, protoSfixed32:
+		return int32(value), nil
+	case protoUint32, protoFixed32:
+		return uint32(value), nil
+	case protoSint32:
+		return int32(uint32(value)>>1) ^ -int32(value&1), nil
+	case protoSint64:
+		return strconv.FormatInt(int64(value>>1)^-int64(value&1), 10), nil
+	case protoBool:
+		return value != 0, nil
+	case protoEnum:
+		if name, ok := protoEnums[field.typeName][int32(value)]; ok {
+			return name, nil
+		}
+
+		return int32(value), nil
+	case protoString:
+		return string(bytes), nil
+	case protoBytes:
+		return bytes, nil
+	case protoNested:
+		message := protoMessages[field.typeName]
+		if message == nil {
+			return nil, fmt.Errorf("unknown message type %s", field.typeName)
+		}
+
+		return decodeProto(bytes, message, depth+1)
+	}
+
+	return nil, fmt.Errorf("unsupported protobuf type %d", field.kind)
+}
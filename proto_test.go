@@ -0,0 +1,186 @@
+package main
+
+import "encoding/binary"
+import "encoding/json"
+import "io/ioutil"
+import "net/http/httptest"
+import "strings"
+import "testing"
+
+// Protobuf encoding for building descriptors and messages by hand.
+func varintField(number, value uint64) []byte {
+	data := binary.AppendUvarint(nil, number<<3)
+	return binary.AppendUvarint(data, value)
+}
+
+func bytesField(number uint64, value []byte) []byte {
+	data := binary.AppendUvarint(nil, number<<3|2)
+	data = binary.AppendUvarint(data, uint64(len(value)))
+	return append(data, value...)
+}
+
+func stringField(number uint64, value string) []byte {
+	return bytesField(number, []byte(value))
+}
+
+func fixed64Field(number, value uint64) []byte {
+	data := binary.AppendUvarint(nil, number<<3|1)
+	return binary.LittleEndian.AppendUint64(data, value)
+}
+
+func joinFields(parts ...[]byte) []byte {
+	var data []byte
+	for _, part := range parts {
+		data = append(data, part...)
+	}
+
+	return data
+}
+
+// A FieldDescriptorProto with an optional type name.
+func protoFieldDescriptor(name string, number, label, kind uint64, typeName string) []byte {
+	field := joinFields(stringField(1, name), varintField(3, number), varintField(4, label), varintField(5, kind))
+	if typeName != "" {
+		field = joinFields(field, stringField(6, typeName))
+	}
+
+	return field
+}
+
+// Write a descriptor set for:
+//
+//	package bsg;
+//	enum Kind { UNKNOWN = 0; TEMPERATURE = 1; }
+//	message Reading {
+//	  message Location { double lat = 1; }
+//	  string serial = 1;
+//	  int32 count = 2;
+//	  repeated sint64 deltas = 3;
+//	  Kind kind = 4;
+//	  Location location = 5;
+//	  bytes raw = 6;
+//	  map<string, int32> totals = 7;
+//	  uint64 device_id = 8;
+//	}
+func writeProtoDescriptor(t *testing.T) string {
+	location := joinFields(stringField(1, "Location"), bytesField(2, protoFieldDescriptor("lat", 1, 1, protoDouble, "")))
+
+	// A map field is a repeated message with the map_entry option.
+	totalsEntry := joinFields(
+		stringField(1, "TotalsEntry"),
+		bytesField(2, protoFieldDescriptor("key", 1, 1, protoString, "")),
+		bytesField(2, protoFieldDescriptor("value", 2, 1, protoInt32, "")),
+		bytesField(7, varintField(7, 1)),
+	)
+
+	reading := joinFields(
+		stringField(1, "Reading"),
+		bytesField(2, protoFieldDescriptor("serial", 1, 1, protoString, "")),
+		bytesField(2, protoFieldDescriptor("count", 2, 1, protoInt32, "")),
+		bytesField(2, protoFieldDescriptor("deltas", 3, 3, protoSint64, "")),
+		bytesField(2, protoFieldDescriptor("kind", 4, 1, protoEnum, ".bsg.Kind")),
+		bytesField(2, protoFieldDescriptor("location", 5, 1, protoNested, ".bsg.Reading.Location")),
+		bytesField(2, protoFieldDescriptor("raw", 6, 1, protoBytes, "")),
+		bytesField(2, protoFieldDescriptor("totals", 7, 3, protoNested, ".bsg.Reading.TotalsEntry")),
+		bytesField(2, protoFieldDescriptor("device_id", 8, 1, protoUint64, "")),
+		bytesField(3, location),
+		bytesField(3, totalsEntry),
+	)
+
+	kind := joinFields(
+		stringField(1, "Kind"),
+		bytesField(2, joinFields(stringField(1, "UNKNOWN"), varintField(2, 0))),
+		bytesField(2, joinFields(stringField(1, "TEMPERATURE"), varintField(2, 1))),
+	)
+
+	file := joinFields(stringField(1, "reading.proto"), stringField(2, "bsg"), bytesField(4, reading), bytesField(5, kind))
+
+	path := t.TempDir() + "/reading.pb"
+	err := ioutil.WriteFile(path, bytesField(1, file), 0644)
+	if err != nil {
+		t.Fatalf("writing descriptor: %s", err)
+	}
+
+	return path
+}
+
+// Load the test descriptor as -proto-descriptor, unloading it afterwards.
+func loadTestProto(t *testing.T) {
+	err := loadProtoDescriptor(writeProtoDescriptor(t), "bsg.Reading")
+	if err != nil {
+		t.Fatalf("loading descriptor: %s", err)
+	}
+
+	t.Cleanup(func() {
+		protoType = nil
+	})
+}
+
+// A Reading with every field set, and a field the descriptor doesn't have.
+var testReading = joinFields(
+	stringField(1, "SN-1"),
+	varintField(2, 7),
+	bytesField(3, []byte{0x02, 0x03, 0x04}),
+	varintField(4, 1),
+	bytesField(5, fixed64Field(1, 0x404a000000000000)),
+	bytesField(6, []byte{0xff, 0x00}),
+	bytesField(7, joinFields(stringField(1, "a"), varintField(2, 3))),
+	bytesField(7, joinFields(stringField(1, "b"), varintField(2, 4))),
+	varintField(8, 1<<60),
+	varintField(9, 42),
+)
+
+func TestProtoDecode(t *testing.T) {
+	loadTestProto(t)
+
+	shown, err := protoToJSON(testReading)
+	if err != nil {
+		t.Fatalf("decoding: %s", err)
+	}
+
+	var decoded map[string]interface{}
+	json.Unmarshal(shown, &decoded)
+
+	want := `{"9":[42],"count":7,"deltas":["1","-2","2"],"deviceId":"1152921504606846976",` +
+		`"kind":"TEMPERATURE","location":{"lat":52},"raw":"/wA=","serial":"SN-1","totals":{"a":3,"b":4}}`
+	if compact, _ := json.Marshal(decoded); string(compact) != want {
+		t.Errorf("decoded to %s, want %s", compact, want)
+	}
+}
+
+func TestProtoInvalid(t *testing.T) {
+	loadTestProto(t)
+
+	for name, data := range map[string][]byte{
+		"truncated string": stringField(1, "SN-1")[:4],
+		"truncated varint": {0x10, 0x80},
+		"wrong wire type":  varintField(1, 5),
+		"group":            {0x0b},
+	} {
+		_, err := protoToJSON(data)
+		if err == nil {
+			t.Errorf("%s: decoded without an error", name)
+		}
+	}
+}
+
+func TestProtoDescriptorMissingMessage(t *testing.T) {
+	err := loadProtoDescriptor(writeProtoDescriptor(t), "bsg.Missing")
+	if err == nil || !strings.Contains(err.Error(), "has no message bsg.Missing") {
+		t.Errorf("loading a missing message gave %v", err)
+	}
+
+	protoType = nil
+}
+
+func TestProtoDataFile(t *testing.T) {
+	loadTestProto(t)
+	setFlag(t, "proto-message", "bsg.Reading")
+
+	output := captureOutput(t)
+	display(httptest.NewRecorder(), dataFileRequest("/datastore", gzipped(testReading)))
+
+	if !strings.Contains(output.String(), "# Decoded bsg.Reading protobuf\n") || !strings.Contains(output.String(), `"serial": "SN-1"`) {
+		t.Errorf("protobuf dataFile not shown as json:\n%s", output)
+	}
+}
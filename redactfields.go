@@ -0,0 +1,86 @@
+package main
+
+import "bytes"
+import "encoding/json"
+import "fmt"
+import "strings"
+
+// Comma separated item fields whose values are replaced before anything is logged or
+// stored.  A plain name matches the field in any value, and key.name only in the values
+// under key, such as item.serial or body.serial.
+var REDACTFIELDS string
+
+const REDACTED = "***"
+
+var redactFields map[string]bool
+
+func parseRedactFields(value string) map[string]bool {
+	fields := make(map[string]bool)
+
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			fields[name] = true
+		}
+	}
+
+	return fields
+}
+
+// Replace the -redact-fields values in a decoded value sent under key.
+func redactItem(key string, item map[string]string) {
+	for field := range item {
+		if redactFields[field] || redactFields[key+"."+field] {
+			item[field] = REDACTED
+		}
+	}
+}
+
+// Redact a payload that isn't an item, such as a raw body or a decoded file.  Json has
+// the -redact-fields values replaced at any depth; anything else that mentions one of
+// the fields can't be redacted, so a note of its size is returned in its place.
+func redactBody(key string, body []byte) []byte {
+	if redactFields == nil {
+		return body
+	}
+
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if decoder.Decode(&value) == nil && !decoder.More() {
+		redacted, _ := json.Marshal(redactValue(key, value))
+		return redacted
+	}
+
+	for field := range redactFields {
+		if index := strings.LastIndex(field, "."); index >= 0 {
+			field = field[index+1:]
+		}
+
+		if bytes.Contains(body, []byte(field)) {
+			return []byte(fmt.Sprintf("(%d bytes withheld under -redact-fields)", len(body)))
+		}
+	}
+
+	return body
+}
+
+func redactValue(key string, value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for field, inner := range value {
+			if redactFields[field] || redactFields[key+"."+field] {
+				value[field] = REDACTED
+			} else {
+				value[field] = redactValue(key, inner)
+			}
+		}
+
+	case []interface{}:
+		for index, inner := range value {
+			value[index] = redactValue(key, inner)
+		}
+	}
+
+	return value
+}
@@ -0,0 +1,268 @@
+package main
+
+import "context"
+import "crypto/rand"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io"
+import "net/http"
+import "net/url"
+import "strconv"
+import "time"
+
+var RESPONSESIZE int64
+var RESPONSEINCLUDEID bool
+var ALLOWSTATUSHEADER bool
+var APPENDNEWLINE bool
+var MIRROR bool
+
+// Under -chunked-response bodies are written in RESPONSECHUNKS flushed pieces, so they go
+// out chunked rather than with a Content-Length.
+var CHUNKEDRESPONSE bool
+var RESPONSECHUNKS int
+var CHUNKDELAY time.Duration
+
+// The request header naming the status to respond with under -allow-status-header.
+const STATUSHEADER = "X-Mock-Status"
+
+// Repeated to build -response-size bodies.
+const FILLER = "{\"success\":\"true\"}\n"
+
+// An endless reader of FILLER.
+type fillerReader struct {
+	offset int
+}
+
+func (reader *fillerReader) Read(buffer []byte) (int, error) {
+	for index := range buffer {
+		buffer[index] = FILLER[(reader.offset+index)%len(FILLER)]
+	}
+	reader.offset += len(buffer)
+
+	return len(buffer), nil
+}
+
+// Flushes after every write, so a streamed body reaches the client as it's produced rather
+// than when the buffer fills.
+type flushWriter struct {
+	writer     io.Writer
+	controller *http.ResponseController
+}
+
+func newFlushWriter(writer http.ResponseWriter) *flushWriter {
+	return &flushWriter{writer, http.NewResponseController(writer)}
+}
+
+func (writer *flushWriter) Write(data []byte) (int, error) {
+	written, err := writer.writer.Write(data)
+	if err == nil {
+		writer.controller.Flush()
+	}
+
+	return written, err
+}
+
+// Stream size bytes of filler as the response body.
+func writeFiller(writer http.ResponseWriter, size int64) {
+	writer.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+
+	_, err := io.CopyN(newFlushWriter(writer), &fillerReader{}, size)
+	if err != nil {
+		fmt.Fprintf(ERRORS, "Error writing response: %s\n", err)
+	}
+}
+
+// A random version 4 UUID.
+func newUUID() string {
+	var id [16]byte
+	rand.Read(id[:])
+
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:])
+}
+
+// Write the success message.  With -response-include-id it also carries a generated id
+// and the request's sequence number: {"success":"true","id":"<uuid>","seq":1}
+func writeSuccess(writer http.ResponseWriter, entry *RequestEntry) {
+	if !RESPONSEINCLUDEID {
+		writeLine(writer, []byte("{\"success\":\"true\"}"))
+		return
+	}
+
+	body, _ := json.Marshal(struct {
+		Success string `json:"success"`
+		ID      string `json:"id"`
+		Seq     int64  `json:"seq"`
+	}{"true", newUUID(), entry.Seq})
+
+	writer.Header().Set("Content-Type", "application/json")
+	writeLine(writer, body)
+}
+
+// The status requested with X-Mock-Status, or 0 if there isn't a valid one.
+func requestedStatus(request *http.Request, entry *RequestEntry) int {
+	value := request.Header.Get(STATUSHEADER)
+	if value == "" {
+		return 0
+	}
+
+	status, err := strconv.Atoi(value)
+	if err != nil || status < 100 || status > 599 {
+		entry.logError("invalid %s: %s", STATUSHEADER, value)
+		return 0
+	}
+
+	fmt.Fprintf(&entry.output, "# responding with %s status %d\n", STATUSHEADER, status)
+
+	return status
+}
+
+// Respond with a status chosen by the client, as an error for 400 and above.
+func writeStatus(writer http.ResponseWriter, status int, entry *RequestEntry) {
+	if status >= 400 {
+		respondError(writer, status, "status requested with "+STATUSHEADER)
+		return
+	}
+
+	writer.WriteHeader(status)
+	if status != http.StatusNoContent && status != http.StatusNotModified {
+		writeSuccess(writer, entry)
+	}
+}
+
+// Write a response body, ending it with a newline under -append-newline.
+func writeLine(writer http.ResponseWriter, body []byte) {
+	if APPENDNEWLINE {
+		body = append(body, '\n')
+	}
+
+	if CHUNKEDRESPONSE {
+		writeChunks(writer, body)
+		return
+	}
+
+	writer.Write(body)
+}
+
+// Write body in -response-chunks pieces, flushing each and waiting -chunk-delay between
+// them.  Flushing before the handler returns is what keeps net/http from adding a
+// Content-Length.  A writer that can't flush gets the rest of the body in one write.
+func writeChunks(writer http.ResponseWriter, body []byte) {
+	ctx := context.Background()
+	if recorder, ok := writer.(*statusRecorder); ok && recorder.ctx != nil {
+		ctx = recorder.ctx
+	}
+
+	controller := http.NewResponseController(writer)
+	size := (len(body) + RESPONSECHUNKS - 1) / RESPONSECHUNKS
+
+	for start := 0; start < len(body); start += size {
+		if start > 0 && CHUNKDELAY > 0 && !sleepContext(ctx, CHUNKDELAY) {
+			fmt.Fprintf(OUTPUT, "# client went away during the chunked response\n")
+			return
+		}
+
+		end := start + size
+		if end > len(body) {
+			end = len(body)
+		}
+
+		_, err := writer.Write(body[start:end])
+		if err == nil {
+			err = controller.Flush()
+		}
+
+		if errors.Is(err, http.ErrNotSupported) {
+			fmt.Fprintf(ERRORS, "# WARNING: the response can't be flushed, sending it unchunked\n")
+			_, err = writer.Write(body[end:])
+			end = len(body)
+		}
+
+		if err != nil {
+			fmt.Fprintf(ERRORS, "Error writing chunked response: %s\n", err)
+			return
+		}
+
+		if end == len(body) {
+			return
+		}
+	}
+}
+
+// Respond with the received items, each given a generated id if it hasn't one, as a 201.
+// A single item is returned as an object with a Location of /datastore/items/<id>, more
+// as an array.  Returns false if there were no items to mirror.
+func writeMirror(writer http.ResponseWriter, entry *RequestEntry) bool {
+	var items []map[string]string
+	for _, key := range []string{"item", "body"} {
+		for _, item := range entry.Values[key] {
+			mirrored := map[string]string{"id": newUUID()}
+			for field, value := range item {
+				mirrored[field] = value
+			}
+
+			items = append(items, mirrored)
+		}
+	}
+
+	if len(items) == 0 {
+		return false
+	}
+
+	var body []byte
+	if len(items) == 1 {
+		body, _ = json.Marshal(items[0])
+		writer.Header().Set("Location", "/datastore/items/"+url.PathEscape(items[0]["id"]))
+	} else {
+		body, _ = json.Marshal(items)
+	}
+
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusCreated)
+	writeLine(writer, body)
+
+	return true
+}
+
+// Records the status of the response written through it, and carries the request's
+// context so -chunk-delay can stop waiting once the client has gone.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	ctx    context.Context
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	if recorder.status == 0 {
+		recorder.status = status
+	}
+
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+func (recorder *statusRecorder) Write(data []byte) (int, error) {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+
+	return recorder.ResponseWriter.Write(data)
+}
+
+func (recorder *statusRecorder) Flush() {
+	recorder.FlushError()
+}
+
+func (recorder *statusRecorder) FlushError() error {
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+
+	return http.NewResponseController(recorder.ResponseWriter).Flush()
+}
+
+func (recorder *statusRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
@@ -0,0 +1,239 @@
+package main
+
+import "bytes"
+import "encoding/json"
+import "fmt"
+import "io/ioutil"
+import "net/http"
+import "strings"
+import "text/template"
+import "time"
+
+var RESPONSESFILE string
+var RESPONSEKEY string
+var PATHRESPONSESFILE string
+var SCENARIOSFILE string
+
+const SCENARIOHEADER = "X-Mock-Scenario"
+
+// A canned response from -responses.  A zero status means 200.
+type fixedResponse struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Body    json.RawMessage   `json:"body"`
+}
+
+// Canned responses keyed by the value of the -response-key item field.
+var RESPONSES map[string]fixedResponse
+
+// Load -responses, a json object mapping item field values to responses, for example
+// {"abc": {"status": 404, "body": {"error": "not found"}}}.
+func loadResponses(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(data, &RESPONSES)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+
+	for value, response := range RESPONSES {
+		if response.Status != 0 && (response.Status < 100 || response.Status > 599) {
+			return fmt.Errorf("%s: %s: invalid status %d", path, value, response.Status)
+		}
+	}
+
+	return nil
+}
+
+// Find the canned response for the first item whose -response-key field has one.
+func matchResponse(entry *RequestEntry) (*fixedResponse, string) {
+	for _, key := range []string{"item", "body"} {
+		for _, item := range entry.Values[key] {
+			value, exists := item[RESPONSEKEY]
+			if !exists {
+				continue
+			}
+
+			response, found := RESPONSES[value]
+			if found {
+				return &response, value
+			}
+		}
+	}
+
+	return nil, ""
+}
+
+func writeFixedResponse(writer http.ResponseWriter, response *fixedResponse) {
+	for key, value := range response.Headers {
+		writer.Header().Set(key, value)
+	}
+
+	if writer.Header().Get("Content-Type") == "" {
+		writer.Header().Set("Content-Type", "application/json")
+	}
+
+	status := response.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	writer.WriteHeader(status)
+	writeLine(writer, response.Body)
+}
+
+// A -path-responses success response, its body a text/template executed with the entry.
+type pathResponse struct {
+	fixedResponse
+	template *template.Template
+}
+
+// Success responses keyed by request path prefix.
+var PATHRESPONSES map[string]*pathResponse
+
+// Load -path-responses, a json object mapping path prefixes to responses, for example
+// {"/datastore/v2/": {"status": 201, "body": "{\"version\":2,\"seq\":{{.Seq}}}"}}.  Bodies
+// aren't json until their templates have run, so they're given as strings.
+func loadPathResponses(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var raw map[string]struct {
+		Status  int               `json:"status"`
+		Headers map[string]string `json:"headers"`
+		Body    string            `json:"body"`
+	}
+
+	err = json.Unmarshal(data, &raw)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+
+	PATHRESPONSES = make(map[string]*pathResponse)
+	for prefix, response := range raw {
+		if !strings.HasPrefix(prefix, "/datastore/") {
+			return fmt.Errorf("%s: %s: prefix must be under /datastore/", path, prefix)
+		}
+
+		if response.Status != 0 && (response.Status < 100 || response.Status > 599) {
+			return fmt.Errorf("%s: %s: invalid status %d", path, prefix, response.Status)
+		}
+
+		body, err := template.New(prefix).Parse(response.Body)
+		if err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+
+		PATHRESPONSES[prefix] = &pathResponse{
+			fixedResponse: fixedResponse{Status: response.Status, Headers: response.Headers},
+			template:      body,
+		}
+	}
+
+	return nil
+}
+
+// The ServeMux patterns for the -path-responses prefixes, each with and without a trailing
+// slash so both /datastore/v1 and everything under it reach display.
+func pathPatterns() []string {
+	seen := map[string]bool{"/datastore": true, "/datastore/stream": true}
+
+	var patterns []string
+	for prefix := range PATHRESPONSES {
+		trimmed := strings.TrimSuffix(prefix, "/")
+		for _, pattern := range []string{trimmed, trimmed + "/"} {
+			if !seen[pattern] {
+				seen[pattern] = true
+				patterns = append(patterns, pattern)
+			}
+		}
+	}
+
+	return patterns
+}
+
+// The response for the longest -path-responses prefix of the request path, with its body
+// rendered for the entry.
+func matchPathResponse(entry *RequestEntry, path string) (*fixedResponse, string) {
+	var matched string
+	for prefix := range PATHRESPONSES {
+		trimmed := strings.TrimSuffix(prefix, "/")
+		if (path == trimmed || strings.HasPrefix(path, trimmed+"/")) && len(prefix) > len(matched) {
+			matched = prefix
+		}
+	}
+
+	if matched == "" {
+		return nil, ""
+	}
+
+	response := PATHRESPONSES[matched]
+
+	var body bytes.Buffer
+	err := response.template.Execute(&body, entry)
+	if err != nil {
+		entry.logError("rendering response for %s: %s", matched, err)
+		return nil, ""
+	}
+
+	rendered := response.fixedResponse
+	rendered.Body = body.Bytes()
+
+	return &rendered, matched
+}
+
+// A -scenarios outcome: a canned response, sent after an optional delay.
+type scenario struct {
+	fixedResponse
+	delay time.Duration
+}
+
+// Outcomes keyed by the X-Mock-Scenario header value.
+var SCENARIOS map[string]*scenario
+
+// Load -scenarios, a json object mapping scenario names to responses with an optional
+// delay, for example {"slow-failure": {"status": 503, "delay": "2s", "body": {"error": "busy"}}}.
+func loadScenarios(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var raw map[string]struct {
+		fixedResponse
+		Delay string `json:"delay"`
+	}
+
+	err = json.Unmarshal(data, &raw)
+	if err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+
+	SCENARIOS = make(map[string]*scenario)
+	for name, outcome := range raw {
+		if outcome.Status != 0 && (outcome.Status < 100 || outcome.Status > 599) {
+			return fmt.Errorf("%s: %s: invalid status %d", path, name, outcome.Status)
+		}
+
+		var delay time.Duration
+		if outcome.Delay != "" {
+			delay, err = time.ParseDuration(outcome.Delay)
+			if err != nil || delay < 0 {
+				return fmt.Errorf("%s: %s: invalid delay %s", path, name, outcome.Delay)
+			}
+		}
+
+		if outcome.Body == nil {
+			outcome.Body = json.RawMessage(`{"success":"true"}`)
+		}
+
+		SCENARIOS[name] = &scenario{outcome.fixedResponse, delay}
+	}
+
+	return nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import "fmt"
+import "strconv"
+import "strings"
+import "sync"
+
+var RESUMABLE bool
+var UPLOADIDHEADER string
+
+// A parsed Content-Range header.  Total is -1 when the sender doesn't know it yet.
+type ContentRange struct {
+	First int64 `json:"first"`
+	Last  int64 `json:"last"`
+	Total int64 `json:"total"`
+}
+
+func (contentRange ContentRange) String() string {
+	total := "*"
+	if contentRange.Total >= 0 {
+		total = strconv.FormatInt(contentRange.Total, 10)
+	}
+
+	return fmt.Sprintf("bytes %d-%d/%s", contentRange.First, contentRange.Last, total)
+}
+
+// Parse a Content-Range of the form 'bytes first-last/total', where total may be '*'.
+func parseContentRange(value string) (ContentRange, error) {
+	var contentRange ContentRange
+
+	spec := strings.TrimPrefix(value, "bytes ")
+	if spec == value {
+		return contentRange, fmt.Errorf("unsupported unit in '%s'", value)
+	}
+
+	span, total, found := strings.Cut(spec, "/")
+	if !found {
+		return contentRange, fmt.Errorf("missing total in '%s'", value)
+	}
+
+	first, last, found := strings.Cut(span, "-")
+	if !found {
+		return contentRange, fmt.Errorf("missing range in '%s'", value)
+	}
+
+	var err error
+	contentRange.First, err = strconv.ParseInt(first, 10, 64)
+	if err != nil {
+		return contentRange, fmt.Errorf("bad first byte in '%s'", value)
+	}
+
+	contentRange.Last, err = strconv.ParseInt(last, 10, 64)
+	if err != nil || contentRange.Last < contentRange.First {
+		return contentRange, fmt.Errorf("bad last byte in '%s'", value)
+	}
+
+	contentRange.Total = -1
+	if total != "*" {
+		contentRange.Total, err = strconv.ParseInt(total, 10, 64)
+		if err != nil || contentRange.Total <= contentRange.Last {
+			return contentRange, fmt.Errorf("bad total in '%s'", value)
+		}
+	}
+
+	return contentRange, nil
+}
+
+// Partial bodies of in progress uploads, keyed by upload id.
+var uploads = make(map[string][]byte)
+var uploadsLock sync.Mutex
+
+// Append a chunk to an upload.  Chunks must arrive in order.  Returns the bytes received
+// so far and, once the last chunk is in, the whole body.
+func addChunk(id string, contentRange ContentRange, chunk []byte) (int64, []byte, error) {
+	uploadsLock.Lock()
+	defer uploadsLock.Unlock()
+
+	data := uploads[id]
+
+	if contentRange.First != int64(len(data)) {
+		return int64(len(data)), nil, fmt.Errorf("expected a chunk starting at byte %d", len(data))
+	}
+
+	if int64(len(chunk)) != contentRange.Last-contentRange.First+1 {
+		return int64(len(data)), nil, fmt.Errorf("chunk is %d bytes but the range is %s",
+			len(chunk), contentRange)
+	}
+
+	data = append(data, chunk...)
+
+	if contentRange.Total >= 0 && int64(len(data)) == contentRange.Total {
+		delete(uploads, id)
+		return int64(len(data)), data, nil
+	}
+
+	uploads[id] = data
+
+	return int64(len(data)), nil, nil
+}
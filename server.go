@@ -0,0 +1,161 @@
+package main
+
+import "bytes"
+import "context"
+import "net/http"
+import "sync"
+
+// The datastore's in-process hooks, for Go tests in this package to assert on requests
+// as they arrive instead of polling /requests.  Options are global, so there's one.
+type Server struct {
+	callbacks []*func(RequestEntry)
+	lock      sync.Mutex
+
+	// Held while callbacks run, so only one runs at a time.
+	calling sync.Mutex
+}
+
+var datastore = &Server{}
+
+// Register callback for each finished request.  It gets a copy of the entry once the
+// response has been sent to the client, or handed to net/http for an -async job's client
+// or an -request-timeout 503, from the goroutine that handled the request.  Callbacks run
+// one at a time, so one that blocks, or waits on a request to this server, holds up every
+// request after it.  It may register or remove callbacks, which take effect for the next
+// request.  Call the returned function to remove it.
+func (server *Server) OnRequest(callback func(RequestEntry)) func() {
+	registered := &callback
+
+	server.lock.Lock()
+	server.callbacks = append(server.callbacks, registered)
+	server.lock.Unlock()
+
+	return func() {
+		server.lock.Lock()
+		defer server.lock.Unlock()
+
+		for index, callback := range server.callbacks {
+			if callback == registered {
+				server.callbacks = append(server.callbacks[:index:index], server.callbacks[index+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func (server *Server) requestFinished(entry *RequestEntry) {
+	server.lock.Lock()
+	callbacks := server.callbacks
+	server.lock.Unlock()
+
+	if len(callbacks) == 0 {
+		return
+	}
+
+	server.calling.Lock()
+	defer server.calling.Unlock()
+
+	for _, callback := range callbacks {
+		(*callback)(entry.copy())
+	}
+}
+
+// An entry that shares nothing with the original, without the unexported working state.
+func (entry *RequestEntry) copy() RequestEntry {
+	copied := *entry
+	copied.stages = nil
+	copied.decoded = nil
+	copied.echo = nil
+	copied.output = bytes.Buffer{}
+
+	copied.Header = copyHeader(entry.Header)
+	copied.ResponseHeader = copyHeader(entry.ResponseHeader)
+
+	if entry.Range != nil {
+		contentRange := *entry.Range
+		copied.Range = &contentRange
+	}
+
+	copied.Files = nil
+	for _, file := range entry.Files {
+		file.Header = copyHeader(file.Header)
+		if file.Gzip != nil {
+			metadata := *file.Gzip
+			file.Gzip = &metadata
+		}
+
+		copied.Files = append(copied.Files, file)
+	}
+
+	copied.Values = make(map[string][]map[string]string, len(entry.Values))
+	for key, items := range entry.Values {
+		var copiedItems []map[string]string
+		for _, item := range items {
+			copiedItem := make(map[string]string, len(item))
+			for field, value := range item {
+				copiedItem[field] = value
+			}
+
+			copiedItems = append(copiedItems, copiedItem)
+		}
+
+		copied.Values[key] = copiedItems
+	}
+
+	copied.Errors = append([]string(nil), entry.Errors...)
+
+	return copied
+}
+
+func copyHeader(header map[string][]string) map[string][]string {
+	if header == nil {
+		return nil
+	}
+
+	return map[string][]string(http.Header(header).Clone())
+}
+
+type finishedKey struct{}
+
+// Where display leaves its entry for callbacksAfter.
+type finishedRequest struct {
+	lock     sync.Mutex
+	entry    *RequestEntry
+	returned bool
+}
+
+// Run the OnRequest callbacks once handler has returned.  http.TimeoutHandler only sends
+// the response it buffered then, so display can't run them itself.  A request that times
+// out is still being handled when the 503 goes out, so it runs them when it finishes.
+func callbacksAfter(handler http.HandlerFunc) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		finished := &finishedRequest{}
+		handler(writer, request.WithContext(context.WithValue(request.Context(), finishedKey{}, finished)))
+
+		finished.lock.Lock()
+		finished.returned = true
+		entry := finished.entry
+		finished.lock.Unlock()
+
+		if entry != nil {
+			datastore.requestFinished(entry)
+		}
+	}
+}
+
+// Called by display once its response is complete.
+func requestFinished(request *http.Request, entry *RequestEntry) {
+	finished, ok := request.Context().Value(finishedKey{}).(*finishedRequest)
+	if ok {
+		finished.lock.Lock()
+		returned := finished.returned
+		finished.entry = entry
+		finished.lock.Unlock()
+
+		if !returned {
+			return
+		}
+	}
+
+	datastore.requestFinished(entry)
+}
@@ -0,0 +1,40 @@
+package main
+
+import "crypto/hmac"
+import "crypto/sha256"
+import "encoding/base64"
+import "encoding/hex"
+import "fmt"
+import "io"
+import "strings"
+
+var HMACSECRET string
+var HMACHEADER string
+
+// Check the -hmac-header signature of a body, logging the result.  The signature is the
+// HMAC-SHA256 of the raw body in hex or base64, optionally prefixed with 'sha256='.
+func verifySignature(output io.Writer, body []byte, signature string) bool {
+	if signature == "" {
+		fmt.Fprintf(output, "# signature missing: no %s header\n", HMACHEADER)
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(HMACSECRET))
+	mac.Write(body)
+	expected := mac.Sum(nil)
+
+	signature = strings.TrimPrefix(strings.TrimSpace(signature), "sha256=")
+
+	given, err := hex.DecodeString(signature)
+	if err != nil {
+		given, err = base64.StdEncoding.DecodeString(signature)
+	}
+
+	if err != nil || !hmac.Equal(given, expected) {
+		fmt.Fprintf(output, "# signature mismatch\n")
+		return false
+	}
+
+	fmt.Fprintf(output, "# signature verified\n")
+	return true
+}
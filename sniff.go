@@ -0,0 +1,67 @@
+package main
+
+import "bufio"
+import "bytes"
+import "fmt"
+import "io"
+import "net/http"
+
+// How much of a body without a Content-Type is looked at to guess one.
+const SNIFFBYTES = 512
+
+// Guess the type of a body sent without a Content-Type, setting the header for multipart
+// and form bodies so they're parsed as usual.  Returns the guessed media type.
+func sniffContentType(request *http.Request) string {
+	reader := bufio.NewReaderSize(request.Body, SNIFFBYTES)
+	start, _ := reader.Peek(SNIFFBYTES)
+	request.Body = struct {
+		io.Reader
+		io.Closer
+	}{reader, request.Body}
+
+	if len(start) == 0 {
+		return ""
+	}
+
+	if bytes.HasPrefix(start, []byte("--")) {
+		line, _, found := bytes.Cut(start[2:], []byte("\r\n"))
+		if found && len(line) > 0 && len(line) <= 70 && !bytes.ContainsAny(line, " \t") {
+			request.Header.Set("Content-Type", fmt.Sprintf("multipart/form-data; boundary=%s", line))
+			return "multipart/form-data"
+		}
+	}
+
+	if looksLikeForm(start) {
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return "application/x-www-form-urlencoded"
+	}
+
+	if start[0] == '{' || start[0] == '[' {
+		return "application/json"
+	}
+
+	mediaType := http.DetectContentType(start)
+	if len(start) > 1 && start[0] == 0x1f && start[1] == 0x8b {
+		mediaType = "application/gzip"
+	}
+
+	return mediaType
+}
+
+// Whether data looks like key=value pairs joined with '&'.
+func looksLikeForm(data []byte) bool {
+	if !bytes.Contains(data, []byte("=")) {
+		return false
+	}
+
+	for _, char := range data {
+		switch {
+		case 'a' <= char && char <= 'z', 'A' <= char && char <= 'Z', '0' <= char && char <= '9':
+		case bytes.IndexByte([]byte("=&%+-_.*~;"), char) >= 0:
+		default:
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,206 @@
+package main
+
+import "encoding/json"
+import "fmt"
+import "io"
+import "net/http"
+import "sort"
+import "strconv"
+import "sync"
+import "sync/atomic"
+import "time"
+
+var COUNTONLY bool
+var SUMMARYINTERVAL time.Duration
+
+// Totals since startup, updated atomically.
+var requestCount int64
+var errorCount int64
+var bytesReceived int64
+
+// Add a finished request to the totals.
+func countRequest(entry *RequestEntry, bytesRead int64) {
+	atomic.AddInt64(&requestCount, 1)
+	atomic.AddInt64(&bytesReceived, bytesRead)
+
+	if len(entry.Errors) != 0 {
+		atomic.AddInt64(&errorCount, 1)
+	}
+
+	countStages(entry)
+	countClient(entry.Client, bytesRead)
+	countProtocol(entry.Proto)
+
+	if STATSD != "" {
+		countStatsd(entry, bytesRead)
+	}
+}
+
+// Totals for one client address, by clientIP.
+type clientTotals struct {
+	Client   string `json:"client"`
+	Requests int64  `json:"requests"`
+	Bytes    int64  `json:"bytes"`
+}
+
+var clients = make(map[string]*clientTotals)
+var clientsLock sync.Mutex
+
+func countClient(client string, bytesRead int64) {
+	clientsLock.Lock()
+	defer clientsLock.Unlock()
+
+	totals, ok := clients[client]
+	if !ok {
+		totals = &clientTotals{Client: client}
+		clients[client] = totals
+	}
+
+	totals.Requests++
+	totals.Bytes += bytesRead
+}
+
+// The top n clients, ordered by less.
+func topClients(n int, less func(first, second clientTotals) bool) []clientTotals {
+	clientsLock.Lock()
+	all := make([]clientTotals, 0, len(clients))
+	for _, totals := range clients {
+		all = append(all, *totals)
+	}
+	clientsLock.Unlock()
+
+	sort.Slice(all, func(first, second int) bool {
+		return less(all[first], all[second])
+	})
+
+	if len(all) > n {
+		all = all[:n]
+	}
+
+	return all
+}
+
+// GET /stats/clients?n=10, the clients sending the most requests and the most bytes.
+func showClients(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		respondError(writer, http.StatusMethodNotAllowed, "only GET is supported")
+		return
+	}
+
+	n := 10
+	if value := request.URL.Query().Get("n"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			respondError(writer, http.StatusBadRequest, "n must be a positive number")
+			return
+		}
+
+		n = parsed
+	}
+
+	body, _ := json.Marshal(map[string][]clientTotals{
+		"by_requests": topClients(n, func(first, second clientTotals) bool {
+			return first.Requests > second.Requests ||
+				first.Requests == second.Requests && first.Client < second.Client
+		}),
+		"by_bytes": topClients(n, func(first, second clientTotals) bool {
+			return first.Bytes > second.Bytes ||
+				first.Bytes == second.Bytes && first.Client < second.Client
+		}),
+	})
+
+	writer.Header().Set("Content-Type", "application/json")
+	writeLine(writer, body)
+}
+
+func formatBytes(count int64) string {
+	const unit = 1000
+
+	if count < unit {
+		return fmt.Sprintf("%d B", count)
+	}
+
+	value := float64(count) / unit
+	for _, prefix := range []string{"kB", "MB", "GB", "TB"} {
+		if value < unit {
+			return fmt.Sprintf("%.1f %s", value, prefix)
+		}
+
+		value /= unit
+	}
+
+	return fmt.Sprintf("%.1f PB", value)
+}
+
+// Print the totals to output every -summary-interval, for -count-only.
+func printSummaries(output io.Writer) {
+	ticker := time.NewTicker(SUMMARYINTERVAL)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		requests := atomic.LoadInt64(&requestCount)
+
+		fmt.Fprintf(output, "[%s] %d requests, %d errors, %s received\n",
+			now.Format(time.RFC3339),
+			requests,
+			atomic.LoadInt64(&errorCount),
+			formatBytes(atomic.LoadInt64(&bytesReceived)))
+
+		failures := atomic.LoadInt64(&storeFailures)
+		if failures > 0 {
+			fmt.Fprintf(output, "[%s] %d failed store writes\n", now.Format(time.RFC3339), failures)
+		}
+
+		if VERBOSE && requests > 0 {
+			fmt.Fprintf(output, "[%s] average timing: %s\n", now.Format(time.RFC3339), averageTiming(requests))
+		}
+	}
+}
+
+// Requests since startup by HTTP version, such as HTTP/1.1 or HTTP/2.0.
+var protocols = make(map[string]int64)
+var protocolsLock sync.Mutex
+
+func countProtocol(proto string) {
+	protocolsLock.Lock()
+	defer protocolsLock.Unlock()
+
+	protocols[proto]++
+}
+
+func protocolCounts() map[string]int64 {
+	protocolsLock.Lock()
+	defer protocolsLock.Unlock()
+
+	counts := make(map[string]int64, len(protocols))
+	for proto, count := range protocols {
+		counts[proto] = count
+	}
+
+	return counts
+}
+
+// GET /stats, the totals and stage timings since startup, and the requests being handled
+// or queued now.
+func showStats(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodGet {
+		respondError(writer, http.StatusMethodNotAllowed, "only GET is supported")
+		return
+	}
+
+	requests := atomic.LoadInt64(&requestCount)
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"requests":       requests,
+		"errors":         atomic.LoadInt64(&errorCount),
+		"bytes_received": atomic.LoadInt64(&bytesReceived),
+		"store_failures": atomic.LoadInt64(&storeFailures),
+		"in_flight":      atomic.LoadInt64(&inFlight),
+		"queued":         atomic.LoadInt64(&queued),
+		"by_protocol":    protocolCounts(),
+		"stages":         stageStats(requests),
+	})
+
+	writer.Header().Set("Content-Type", "application/json")
+	writeLine(writer, body)
+}
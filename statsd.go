@@ -0,0 +1,97 @@
+package main
+
+import "bytes"
+import "fmt"
+import "io"
+import "net"
+import "strconv"
+import "sync"
+import "time"
+
+// A StatsD UDP address to send request metrics to.
+var STATSD string
+
+const STATSDPREFIX = "datastore."
+
+// Metrics are sent once a second, in packets small enough not to fragment.
+const STATSDINTERVAL = time.Second
+const STATSDPACKET = 1432
+
+// Metrics gathered since the last send.
+var statsdRequests int64
+var statsdErrors int64
+var statsdBytes int64
+var statsdDurations []float64
+var statsdLock sync.Mutex
+
+func countStatsd(entry *RequestEntry, bytesRead int64) {
+	statsdLock.Lock()
+	defer statsdLock.Unlock()
+
+	statsdRequests++
+	statsdErrors += int64(len(entry.Errors))
+	statsdBytes += bytesRead
+	statsdDurations = append(statsdDurations, entry.DurationMS)
+}
+
+// The metrics gathered since the last call, as StatsD lines.
+func statsdLines() []string {
+	statsdLock.Lock()
+	defer statsdLock.Unlock()
+
+	if statsdRequests == 0 {
+		return nil
+	}
+
+	lines := []string{
+		STATSDPREFIX + "requests:" + strconv.FormatInt(statsdRequests, 10) + "|c",
+		STATSDPREFIX + "errors:" + strconv.FormatInt(statsdErrors, 10) + "|c",
+		STATSDPREFIX + "bytes:" + strconv.FormatInt(statsdBytes, 10) + "|c",
+	}
+
+	for _, duration := range statsdDurations {
+		lines = append(lines, STATSDPREFIX+"duration:"+strconv.FormatFloat(duration, 'f', 3, 64)+"|ms")
+	}
+
+	statsdRequests, statsdErrors, statsdBytes = 0, 0, 0
+	statsdDurations = nil
+
+	return lines
+}
+
+// Send the gathered metrics every STATSDINTERVAL, packing as many lines into each packet
+// as fit.
+func sendStatsd(conn net.Conn, output io.Writer) {
+	for range time.Tick(STATSDINTERVAL) {
+		var packet bytes.Buffer
+
+		for _, line := range statsdLines() {
+			if packet.Len() != 0 && packet.Len()+1+len(line) > STATSDPACKET {
+				writeStatsd(conn, packet.Bytes(), output)
+				packet.Reset()
+			}
+
+			if packet.Len() != 0 {
+				packet.WriteByte('\n')
+			}
+			packet.WriteString(line)
+		}
+
+		if packet.Len() != 0 {
+			writeStatsd(conn, packet.Bytes(), output)
+		}
+	}
+}
+
+// Set while sends are failing, so only the first failure in a row is reported.
+var statsdFailing bool
+
+// Nothing may be listening, so failed sends are only reported.
+func writeStatsd(conn net.Conn, packet []byte, output io.Writer) {
+	_, err := conn.Write(packet)
+	if err != nil && !statsdFailing {
+		fmt.Fprintf(output, "# WARNING: sending to -statsd %s: %s\n", STATSD, err)
+	}
+
+	statsdFailing = err != nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import "bytes"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io"
+import "io/ioutil"
+import "net/http"
+import "os"
+import "path/filepath"
+import "strings"
+import "sync/atomic"
+
+var STOREDIR string
+var STOREDECODED bool
+var STOREREQUIRED bool
+var CAPTURERAW bool
+
+// Failed writes since startup, updated atomically.  Only every STOREFAILLOG-th failure
+// after the first is logged, so a full disk doesn't flood the output.
+var storeFailures int64
+
+const STOREFAILLOG = 100
+
+var STOREFIELDS string
+
+// The -store-fields, or nil to store just the payload.
+var storeFields map[string]bool
+
+// The entry json keys kept for each -store-fields name.  The two without a key of their
+// own aren't entry fields: 'datafile' keeps the data of each file in the files list, so it
+// implies 'files', and 'payload' also stores the usual payload files.
+var STOREFIELDNAMES = map[string]string{
+	"headers":  "header",
+	"items":    "values",
+	"body":     "body",
+	"files":    "files",
+	"datafile": "",
+	"errors":   "errors",
+	"payload":  "",
+}
+
+func parseStoreFields(value string) (map[string]bool, error) {
+	fields := make(map[string]bool)
+
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if _, ok := STOREFIELDNAMES[name]; !ok {
+			return nil, fmt.Errorf("unknown field '%s'", name)
+		}
+
+		fields[name] = true
+	}
+
+	if fields["datafile"] {
+		fields["files"] = true
+	}
+
+	return fields, nil
+}
+
+// Write <base>.entry.json with the entry's metadata and the -store-fields asked for.
+func storeEntry(base string, entry *RequestEntry) error {
+	stored := *entry
+
+	if !storeFields["datafile"] {
+		stored.Files = nil
+		for _, file := range entry.Files {
+			file.Data = ""
+			stored.Files = append(stored.Files, file)
+		}
+	}
+
+	data, err := json.Marshal(&stored)
+	if err != nil {
+		return err
+	}
+
+	var object map[string]json.RawMessage
+	json.Unmarshal(data, &object)
+
+	for name, key := range STOREFIELDNAMES {
+		if key != "" && !storeFields[name] {
+			delete(object, key)
+		}
+	}
+
+	data, _ = json.MarshalIndent(object, "", "  ")
+
+	err = ioutil.WriteFile(base+".entry.json", data, 0644)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(&entry.output, "# stored entry as %s.entry.json\n", base)
+
+	return nil
+}
+
+var errNothingDecoded = errors.New("nothing was decoded")
+
+// A fully decoded payload kept for -store-decoded.
+type decodedPart struct {
+	name string
+	data []byte
+}
+
+// Keep a decoded payload for -store-decoded, pretty printing json.  Under -redact-fields
+// it's kept redacted.
+func (entry *RequestEntry) keepDecoded(name string, data []byte) {
+	if !STOREDECODED {
+		return
+	}
+	data = redactBody(name, data)
+
+	var pretty bytes.Buffer
+	if json.Indent(&pretty, data, "", "  ") == nil {
+		data = pretty.Bytes()
+	}
+
+	entry.decoded = append(entry.decoded, decodedPart{name, data})
+}
+
+// Write the request to -store-dir.  With -store-fields that's a json summary of the chosen
+// fields, plus the payload only if 'payload' is one of them.  Returns false if it couldn't
+// be written.
+func storeRequest(entry *RequestEntry, body []byte) bool {
+	base := storeBase(entry)
+
+	if storeIndex != nil {
+		err := indexRequest(entry)
+		if err != nil {
+			storeFailed(err)
+			return false
+		}
+	}
+
+	if storeFields != nil {
+		err := storeEntry(base, entry)
+		if err != nil {
+			storeFailed(err)
+			return false
+		}
+
+		if !storeFields["payload"] {
+			return true
+		}
+	}
+
+	return storePayload(base, entry, body)
+}
+
+// The path in -store-dir, less its extension, of the files stored for a request.
+func storeBase(entry *RequestEntry) string {
+	return filepath.Join(STOREDIR, fmt.Sprintf("%s-%d",
+		entry.Time.Format("20060102T150405.000000"), entry.Seq))
+}
+
+// Copies the body to a -capture-raw file as it's read.
+type captureReader struct {
+	io.Reader
+	body io.Closer
+	file *os.File
+}
+
+func (reader *captureReader) Close() error {
+	io.Copy(ioutil.Discard, reader.Reader)
+	reader.file.Close()
+
+	return reader.body.Close()
+}
+
+// Whether the raw body is teed into -store-dir as it's read rather than stored from a
+// copy: always under -capture-raw, and under -sample so a huge upload isn't held in
+// memory just to be stored.  The raw body is never stored under -redact-fields.
+func teeRawBody() bool {
+	return CAPTURERAW || (SAMPLE && STOREDIR != "" && redactFields == nil)
+}
+
+// Under -capture-raw, tee the request body into <base>.raw in -store-dir, byte for byte as
+// it's read, before anything has parsed it.  Whatever the handler leaves unread is copied
+// when the body is closed.
+func captureBody(request *http.Request, entry *RequestEntry) *captureReader {
+	file, err := os.Create(storeBase(entry) + ".raw")
+	if err != nil {
+		storeFailed(err)
+		return nil
+	}
+
+	capture := &captureReader{io.TeeReader(request.Body, file), request.Body, file}
+	request.Body = capture
+
+	return capture
+}
+
+// Write the raw body, or with -store-decoded the decoded values and parts, falling back
+// to the raw body if it couldn't be decoded.  Under -redact-fields the raw body, which
+// can't be redacted, is never written.
+func storePayload(base string, entry *RequestEntry, body []byte) bool {
+	if STOREDECODED || redactFields != nil {
+		err := errors.New("decoding failed")
+		if len(entry.Errors) == 0 {
+			err = storeDecoded(base, entry)
+			if err == nil {
+				return true
+			}
+
+			if !errors.Is(err, errNothingDecoded) {
+				storeFailed(err)
+				return false
+			}
+		}
+
+		if redactFields != nil {
+			fmt.Fprintf(&entry.output, "# Note: not storing the raw payload under -redact-fields: %s\n", err)
+			return true
+		}
+
+		fmt.Fprintf(&entry.output, "# Note: storing the raw payload: %s\n", err)
+	}
+
+	// It was teed to the store as it was read.
+	if teeRawBody() {
+		return true
+	}
+
+	err := ioutil.WriteFile(base+".raw", body, 0644)
+	if err != nil {
+		storeFailed(err)
+		return false
+	}
+
+	fmt.Fprintf(&entry.output, "# stored as %s.raw\n", base)
+
+	return true
+}
+
+func storeFailed(err error) {
+	failures := atomic.AddInt64(&storeFailures, 1)
+	if failures == 1 || failures%STOREFAILLOG == 0 {
+		fmt.Fprintf(ERRORS, "# WARNING: store unavailable, %d failed writes so far: %s\n", failures, err)
+	}
+}
+
+func storeDecoded(base string, entry *RequestEntry) error {
+	if len(entry.Values) == 0 && len(entry.decoded) == 0 {
+		return errNothingDecoded
+	}
+
+	if len(entry.Values) != 0 {
+		values, _ := json.MarshalIndent(entry.Values, "", "  ")
+
+		err := ioutil.WriteFile(base+".json", values, 0644)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(&entry.output, "# stored values as %s.json\n", base)
+	}
+
+	// Repeated names are numbered.
+	seen := make(map[string]int)
+	for _, part := range entry.decoded {
+		safe := strings.ReplaceAll(part.name, "/", "_")
+		safe = strings.ReplaceAll(safe, string(filepath.Separator), "_")
+
+		name := fmt.Sprintf("%s.%s", base, safe)
+		if seen[safe] > 0 {
+			name = fmt.Sprintf("%s.%s.%d", base, safe, seen[safe])
+		}
+		seen[safe]++
+
+		err := ioutil.WriteFile(name, part.data, 0644)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(&entry.output, "# stored %s as %s\n", part.name, name)
+	}
+
+	return nil
+}
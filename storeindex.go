@@ -0,0 +1,79 @@
+package main
+
+import "encoding/csv"
+import "encoding/json"
+import "os"
+import "path/filepath"
+import "strconv"
+import "sync"
+import "time"
+
+// With -store-dir, a summary of every request appended to requests.jsonl or requests.csv
+// alongside the per-request files.  Empty for none.
+var STOREFORMAT string
+
+var CSVCOLUMNS = []string{
+	"seq", "timestamp", "method", "content_length", "items", "datafile_bytes", "errors",
+}
+
+var storeIndex *os.File
+var storeCSV *csv.Writer
+var storeIndexLock sync.Mutex
+
+// Open the -store-format summary for appending, writing the csv header if it's new.
+func openStoreIndex() error {
+	file, err := os.OpenFile(filepath.Join(STOREDIR, "requests."+STOREFORMAT),
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	storeIndex = file
+
+	if STOREFORMAT == "csv" {
+		storeCSV = csv.NewWriter(file)
+
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+
+		if info.Size() == 0 {
+			storeCSV.Write(CSVCOLUMNS)
+			storeCSV.Flush()
+			return storeCSV.Error()
+		}
+	}
+
+	return nil
+}
+
+// Append the request's summary line or row.
+func indexRequest(entry *RequestEntry) error {
+	storeIndexLock.Lock()
+	defer storeIndexLock.Unlock()
+
+	if storeCSV != nil {
+		storeCSV.Write([]string{
+			strconv.FormatInt(entry.Seq, 10),
+			entry.Time.Format(time.RFC3339Nano),
+			entry.Method,
+			strconv.FormatInt(entry.ContentLength, 10),
+			strconv.Itoa(entry.ItemCount()),
+			strconv.Itoa(entry.DataFileBytes),
+			strconv.Itoa(len(entry.Errors)),
+		})
+		storeCSV.Flush()
+
+		return storeCSV.Error()
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = storeIndex.Write(append(data, '\n'))
+
+	return err
+}
@@ -0,0 +1,100 @@
+package main
+
+import "fmt"
+import "io"
+import "net/http"
+import "time"
+
+var STREAMECHO bool
+
+// Accept a websocket on /datastore/stream, decoding each message like a request body.
+// Each message takes a -max-concurrent slot while it's handled, and -validate-only
+// messages are only checked.  There's no response to shape, so -strict, faults,
+// -fail-after, delays and canned responses don't apply; -stream-echo is the only answer.
+func stream(writer http.ResponseWriter, request *http.Request) {
+	client := clientIP(request)
+
+	ws, err := upgradeWebsocket(writer, request)
+	if err != nil {
+		fmt.Fprintf(OUTPUT, "# websocket upgrade from %s failed: %s\n\n", client, err)
+		respondError(writer, http.StatusBadRequest, err.Error())
+		return
+	}
+	defer ws.Close()
+
+	fmt.Fprintf(OUTPUT, "# websocket connected from %s\n\n", client)
+
+	for count := 1; ; count++ {
+		opcode, message, err := ws.ReadMessage()
+		if err == io.EOF {
+			fmt.Fprintf(OUTPUT, "# websocket from %s closed\n\n", client)
+			return
+		}
+
+		if err != nil {
+			fmt.Fprintf(OUTPUT, "# websocket from %s failed: %s\n\n", client, err)
+			return
+		}
+
+		// Each message is handled like a request with message as its body.  A message
+		// that gets no slot fails the connection, as a 503 would for a request.
+		if slots != nil && !acquireSlot(request.Context()) {
+			ws.fail(closeTryAgainLater, "too many concurrent requests")
+			fmt.Fprintf(OUTPUT, "# websocket message %d from %s got no slot, connection closed\n\n", count, client)
+			return
+		}
+
+		entry := newRequestEntry()
+		entry.Method = "WEBSOCKET"
+		entry.URL = request.URL.String()
+		entry.Host = request.Host
+		entry.Proto = request.Proto
+		entry.Client = client
+		entry.Header = redact(request.Header)
+		entry.ContentLength = int64(len(message))
+		entry.BytesRead = int64(len(message))
+
+		fmt.Fprintf(&entry.output, "######\n")
+		fmt.Fprintf(&entry.output, "# websocket message %d from %s\n", count, client)
+		fmt.Fprintf(&entry.output, "# seq %d\n", entry.Seq)
+		fmt.Fprintf(&entry.output, "# %d bytes\n", len(message))
+
+		displayPayload(message, entry)
+
+		if VALIDATEONLY {
+			printValidation(&entry.output, validate(request, entry))
+		}
+
+		elapsed := time.Since(entry.Time)
+		entry.DurationMS = float64(elapsed) / float64(time.Millisecond)
+
+		if STOREDIR != "" && !VALIDATEONLY {
+			storeRequest(entry, message)
+		}
+
+		fmt.Fprintf(&entry.output, "######\n\n\n")
+		entry.flushOutput()
+
+		finishRequest(entry, int64(len(message)))
+
+		if slots != nil {
+			releaseSlot()
+		}
+
+		if runsHook() {
+			go runHook(entry)
+		}
+
+		if STREAMECHO {
+			err = ws.WriteMessage(opcode, message)
+		}
+
+		// The echo, if any, is this message's response.
+		datastore.requestFinished(entry)
+
+		if err != nil {
+			fmt.Fprintf(OUTPUT, "# websocket from %s failed: %s\n\n", client, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import "errors"
+import "fmt"
+import "io"
+import "os"
+import "syscall"
+import "time"
+
+// A file or FIFO each finished entry is appended to as a json line.
+var TAIL string
+
+// The shortest time between two -tail error messages; errors in between are only counted.
+var tailErrorInterval = time.Minute
+
+// The -tail file, reopened after any failed write.
+type tailFile struct {
+	path    string
+	console io.Writer
+	file    *os.File
+
+	lastError  time.Time
+	suppressed int
+}
+
+// Append each published entry to path as a line, reopening a FIFO whose reader went away.
+// While nobody is reading, entries queue like a /live subscriber's, up to LIVEBUFFER.
+func tailEntries(path string, console io.Writer) {
+	subscriber := subscribe()
+
+	tail := &tailFile{path: path, console: console}
+	for data := range subscriber.entries {
+		tail.write(append(data, '\n'))
+	}
+}
+
+// Write a line, opening the file if needed. A line that fails with anything but
+// EPIPE is dropped, and the file is closed so the next line reopens it.
+func (tail *tailFile) write(line []byte) {
+	for {
+		if tail.file == nil {
+			opened, err := os.OpenFile(tail.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				tail.reportError("Error opening -tail %s: %s", tail.path, err)
+				time.Sleep(time.Second)
+				continue
+			}
+
+			tail.file = opened
+		}
+
+		_, err := tail.file.Write(line)
+		if err == nil {
+			return
+		}
+
+		tail.file.Close()
+		tail.file = nil
+
+		if errors.Is(err, syscall.EPIPE) {
+			fmt.Fprintf(tail.console, "# -tail reader on %s went away\n", tail.path)
+			continue
+		}
+
+		tail.reportError("Error writing -tail %s: %s", tail.path, err)
+		return
+	}
+}
+
+// Print an error at most once per tailErrorInterval, with how many were skipped since the last.
+func (tail *tailFile) reportError(format string, args ...interface{}) {
+	now := time.Now()
+	if !tail.lastError.IsZero() && now.Sub(tail.lastError) < tailErrorInterval {
+		tail.suppressed++
+		return
+	}
+
+	message := fmt.Sprintf(format, args...)
+	if tail.suppressed > 0 {
+		message += fmt.Sprintf(" (%d more since the last message)", tail.suppressed)
+	}
+
+	fmt.Fprintln(ERRORS, message)
+	tail.lastError = now
+	tail.suppressed = 0
+}
@@ -0,0 +1,39 @@
+package main
+
+import "bytes"
+import "io/ioutil"
+import "os"
+import "strings"
+import "testing"
+import "time"
+
+func TestTailWriteErrors(t *testing.T) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("no /dev/full to fail writes")
+	}
+
+	var printed bytes.Buffer
+	ERRORS = &printed
+	t.Cleanup(func() {
+		ERRORS = ioutil.Discard
+	})
+
+	tail := &tailFile{path: "/dev/full", console: ioutil.Discard}
+	for i := 0; i < 3; i++ {
+		tail.write([]byte("{}\n"))
+		if tail.file != nil {
+			t.Fatalf("write %d left the failed file open", i)
+		}
+	}
+
+	if count := strings.Count(printed.String(), "Error writing -tail"); count != 1 {
+		t.Errorf("3 failed writes within the interval printed %d errors:\n%s", count, printed.String())
+	}
+
+	tail.lastError = time.Now().Add(-tailErrorInterval)
+	tail.write([]byte("{}\n"))
+
+	if !strings.Contains(printed.String(), "(2 more since the last message)") {
+		t.Errorf("error after the interval didn't count the skipped ones:\n%s", printed.String())
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import "fmt"
+import "strings"
+import "sync/atomic"
+import "time"
+
+// The stages timed for each request, in the order they're shown.
+var STAGES = []string{"read", "parse", "gzip", "base64", "json"}
+
+// Total nanoseconds spent in each of STAGES since startup, updated atomically.
+var stageTotals = make([]int64, len(STAGES))
+
+// Add the time since start to a stage.
+func (entry *RequestEntry) timeStage(stage string, start time.Time) {
+	entry.addStage(stage, time.Since(start))
+}
+
+func (entry *RequestEntry) addStage(stage string, elapsed time.Duration) {
+	if entry.stages == nil {
+		entry.stages = make(map[string]time.Duration)
+	}
+
+	entry.stages[stage] += elapsed
+}
+
+// Time spent in the stages that happen while parsing, so parse can be shown without them.
+func (entry *RequestEntry) decodeTime() time.Duration {
+	return entry.stages["gzip"] + entry.stages["base64"] + entry.stages["json"]
+}
+
+// read=2ms parse=5ms gzip=40ms base64=1ms json=3ms
+func (entry *RequestEntry) formatTiming() string {
+	var fields []string
+
+	for _, stage := range STAGES {
+		fields = append(fields, fmt.Sprintf("%s=%s", stage, entry.stages[stage].Round(time.Microsecond)))
+	}
+
+	return strings.Join(fields, " ")
+}
+
+func countStages(entry *RequestEntry) {
+	for index, stage := range STAGES {
+		atomic.AddInt64(&stageTotals[index], int64(entry.stages[stage]))
+	}
+}
+
+// The average time per request spent in each stage, formatted like formatTiming.
+func averageTiming(requests int64) string {
+	var fields []string
+
+	for index, stage := range STAGES {
+		average := time.Duration(atomic.LoadInt64(&stageTotals[index]) / requests)
+		fields = append(fields, fmt.Sprintf("%s=%s", stage, average.Round(time.Microsecond)))
+	}
+
+	return strings.Join(fields, " ")
+}
+
+// The total and average milliseconds per request spent in each stage, for /stats.
+func stageStats(requests int64) map[string]map[string]float64 {
+	stats := make(map[string]map[string]float64, len(STAGES))
+
+	for index, stage := range STAGES {
+		total := float64(atomic.LoadInt64(&stageTotals[index])) / float64(time.Millisecond)
+
+		var average float64
+		if requests > 0 {
+			average = total / float64(requests)
+		}
+
+		stats[stage] = map[string]float64{"total_ms": total, "average_ms": average}
+	}
+
+	return stats
+}
@@ -0,0 +1,67 @@
+package main
+
+import "encoding/json"
+import "fmt"
+import "io"
+import "net/http"
+
+var VALIDATEONLY bool
+
+// Item fields the datastore refuses an item without.
+var REQUIREDITEMFIELDS = []string{"serial", "type"}
+
+// Check a decoded request for anything the datastore would refuse, returning a
+// description of each problem.
+func validate(request *http.Request, entry *RequestEntry) []string {
+	problems := append([]string{}, entry.Errors...)
+
+	switch mediaType(request) {
+	case "multipart/form-data", "application/x-www-form-urlencoded":
+	default:
+		if RAWBODY == "false" {
+			problems = append(problems, fmt.Sprintf("unsupported Content-Type '%s'",
+				request.Header.Get("Content-Type")))
+		}
+	}
+
+	items := append(entry.Values["item"], entry.Values["body"]...)
+	if len(items) == 0 {
+		problems = append(problems, "no item received")
+	}
+
+	for index, item := range items {
+		for _, field := range REQUIREDITEMFIELDS {
+			if item[field] == "" {
+				problems = append(problems, fmt.Sprintf("item %d is missing '%s'", index, field))
+			}
+		}
+	}
+
+	return problems
+}
+
+func printValidation(output io.Writer, problems []string) {
+	if len(problems) == 0 {
+		fmt.Fprintf(output, "# validation passed\n")
+		return
+	}
+
+	fmt.Fprintf(output, "# validation failed:\n")
+	for _, problem := range problems {
+		fmt.Fprintf(output, "#\t%s\n", problem)
+	}
+}
+
+func respondValidation(writer http.ResponseWriter, problems []string) {
+	writer.Header().Set("Content-Type", "application/json")
+
+	if len(problems) == 0 {
+		writeLine(writer, []byte("{\"valid\":true}"))
+		return
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{"valid": false, "errors": problems})
+
+	writer.WriteHeader(http.StatusBadRequest)
+	writeLine(writer, body)
+}
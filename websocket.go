@@ -0,0 +1,269 @@
+package main
+
+import "bufio"
+import "crypto/sha1"
+import "encoding/base64"
+import "encoding/binary"
+import "errors"
+import "io"
+import "net"
+import "net/http"
+import "strings"
+import "sync"
+import "unicode/utf8"
+
+// A minimal RFC 6455 websocket server connection.
+
+const WEBSOCKETGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// The largest websocket message accepted.
+const MAXMESSAGEBYTES = 32 << 20
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// Close codes for failing a connection.
+const (
+	closeProtocolError = 1002
+	closeInvalidData   = 1007
+	closeTooBig        = 1009
+	closeTryAgainLater = 1013
+)
+
+var ErrNotWebsocket = errors.New("not a websocket upgrade request")
+
+type websocketConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	// Held while writing a frame, as pongs may be sent while another goroutine writes.
+	writeLock sync.Mutex
+}
+
+func headerHasToken(header http.Header, key string, token string) bool {
+	for _, value := range header.Values(key) {
+		for _, element := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(element), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Answer a websocket handshake and take over the connection.  When an error is returned
+// the connection hasn't been touched, so the caller can still respond.
+func upgradeWebsocket(writer http.ResponseWriter, request *http.Request) (*websocketConn, error) {
+	if !headerHasToken(request.Header, "Connection", "upgrade") ||
+		!headerHasToken(request.Header, "Upgrade", "websocket") {
+		return nil, ErrNotWebsocket
+	}
+
+	if request.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, errors.New("unsupported websocket version")
+	}
+
+	key := request.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		return nil, errors.New("missing Sec-WebSocket-Key")
+	}
+
+	hijacker, ok := writer.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("connection can't be taken over")
+	}
+
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha1.Sum([]byte(key + WEBSOCKETGUID))
+
+	buffered.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(hash[:]) + "\r\n\r\n")
+
+	err = buffered.Flush()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &websocketConn{conn: conn, reader: buffered.Reader}, nil
+}
+
+// Fail the connection as RFC 6455 section 7.1.7 says, sending a close frame with code
+// before the caller closes it, and return the problem as an error.
+func (ws *websocketConn) fail(code uint16, problem string) error {
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	ws.WriteMessage(opClose, append(payload, problem...))
+
+	return errors.New(problem)
+}
+
+func (ws *websocketConn) readFrame() (bool, byte, []byte, error) {
+	var header [2]byte
+
+	_, err := io.ReadFull(ws.reader, header[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+
+	// No extensions are negotiated, so the reserved bits must be clear, and every frame
+	// from a client must be masked.
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, ws.fail(closeProtocolError, "websocket frame has reserved bits set")
+	}
+
+	if !masked {
+		return false, 0, nil, ws.fail(closeProtocolError, "websocket frame from the client isn't masked")
+	}
+
+	// Control frames can't be fragmented, and their length fits in the first byte.
+	if opcode&0x8 != 0 && (!fin || length > 125) {
+		return false, 0, nil, ws.fail(closeProtocolError, "websocket control frame is fragmented or too long")
+	}
+
+	switch length {
+	case 126:
+		var extended [2]byte
+		_, err = io.ReadFull(ws.reader, extended[:])
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+
+	case 127:
+		var extended [8]byte
+		_, err = io.ReadFull(ws.reader, extended[:])
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	if length > MAXMESSAGEBYTES {
+		return false, 0, nil, ws.fail(closeTooBig, "websocket frame too large")
+	}
+
+	var mask [4]byte
+	_, err = io.ReadFull(ws.reader, mask[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(ws.reader, payload)
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	for index := range payload {
+		payload[index] ^= mask[index%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// Returns the next text or binary message, answering pings along the way.  Returns
+// io.EOF once the client closes the connection.  A protocol error, or a text message that
+// isn't UTF-8, fails the connection.
+func (ws *websocketConn) ReadMessage() (byte, []byte, error) {
+	var opcode byte
+	var message []byte
+
+	for {
+		fin, frameOpcode, payload, err := ws.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch frameOpcode {
+		case opPing:
+			err = ws.WriteMessage(opPong, payload)
+			if err != nil {
+				return 0, nil, err
+			}
+			continue
+
+		case opPong:
+			continue
+
+		case opClose:
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			ws.WriteMessage(opClose, payload)
+			return 0, nil, io.EOF
+
+		case opText, opBinary:
+			if opcode != 0 {
+				return 0, nil, ws.fail(closeProtocolError, "websocket message interrupted by another")
+			}
+			opcode = frameOpcode
+
+		case opContinuation:
+			if opcode == 0 {
+				return 0, nil, ws.fail(closeProtocolError, "websocket continuation without a message")
+			}
+
+		default:
+			return 0, nil, ws.fail(closeProtocolError, "unknown websocket opcode")
+		}
+
+		if len(message)+len(payload) > MAXMESSAGEBYTES {
+			return 0, nil, ws.fail(closeTooBig, "websocket message too large")
+		}
+		message = append(message, payload...)
+
+		if fin {
+			if opcode == opText && !utf8.Valid(message) {
+				return 0, nil, ws.fail(closeInvalidData, "websocket text message isn't UTF-8")
+			}
+
+			return opcode, message, nil
+		}
+	}
+}
+
+// Send a single unfragmented frame.
+func (ws *websocketConn) WriteMessage(opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+
+	length := len(payload)
+	switch {
+	case length < 126:
+		header = append(header, byte(length))
+
+	case length <= 0xffff:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+
+	_, err := ws.conn.Write(append(header, payload...))
+
+	return err
+}
+
+func (ws *websocketConn) Close() error {
+	return ws.conn.Close()
+}
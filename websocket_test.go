@@ -0,0 +1,77 @@
+package main
+
+import "bufio"
+import "bytes"
+import "encoding/binary"
+import "net"
+import "testing"
+
+// Keeps whatever the server writes.
+type recordingConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (conn *recordingConn) Write(data []byte) (int, error) {
+	return conn.written.Write(data)
+}
+
+// A client frame with a zero mask, which leaves the payload as it is.
+func clientFrame(first byte, payload []byte) []byte {
+	return append([]byte{first, 0x80 | byte(len(payload)), 0, 0, 0, 0}, payload...)
+}
+
+func TestWebsocketProtocolErrors(t *testing.T) {
+	for name, test := range map[string]struct {
+		frames []byte
+		code   uint16
+	}{
+		"unmasked frame":      {[]byte{0x80 | opText, 2, 'h', 'i'}, closeProtocolError},
+		"reserved bits":       {clientFrame(0xc0|opText, []byte("hi")), closeProtocolError},
+		"fragmented ping":     {clientFrame(opPing, nil), closeProtocolError},
+		"long ping":           {append([]byte{0x80 | opPing, 0x80 | 126, 0, 126, 0, 0, 0, 0}, make([]byte, 126)...), closeProtocolError},
+		"unknown opcode":      {clientFrame(0x80|0x3, nil), closeProtocolError},
+		"invalid UTF-8 text":  {clientFrame(0x80|opText, []byte{0xff, 0xfe}), closeInvalidData},
+		"split invalid UTF-8": {append(clientFrame(opText, []byte{0xe2, 0x82}), clientFrame(0x80|opContinuation, []byte{0x28})...), closeInvalidData},
+		"continuation first":  {clientFrame(0x80|opContinuation, []byte("hi")), closeProtocolError},
+	} {
+		conn := &recordingConn{}
+		ws := &websocketConn{conn: conn, reader: bufio.NewReader(bytes.NewReader(test.frames))}
+
+		_, _, err := ws.ReadMessage()
+		if err == nil {
+			t.Errorf("%s: read without an error", name)
+			continue
+		}
+
+		written := conn.written.Bytes()
+		if len(written) < 4 || written[0] != 0x80|opClose || binary.BigEndian.Uint16(written[2:]) != test.code {
+			t.Errorf("%s: sent %x, want a close with code %d", name, written, test.code)
+		}
+	}
+}
+
+func TestWebsocketValidMessages(t *testing.T) {
+	// A text message split across frames with a ping between them, then binary that
+	// isn't UTF-8.
+	frames := append(clientFrame(opText, []byte{'c', 'a', 0xc3}), clientFrame(0x80|opPing, []byte("p"))...)
+	frames = append(frames, clientFrame(0x80|opContinuation, []byte{0xa9})...)
+	frames = append(frames, clientFrame(0x80|opBinary, []byte{0xff})...)
+
+	conn := &recordingConn{}
+	ws := &websocketConn{conn: conn, reader: bufio.NewReader(bytes.NewReader(frames))}
+
+	opcode, message, err := ws.ReadMessage()
+	if err != nil || opcode != opText || string(message) != "caé" {
+		t.Errorf("text message read as %d %q: %v", opcode, message, err)
+	}
+
+	if !bytes.Equal(conn.written.Bytes(), []byte{0x80 | opPong, 1, 'p'}) {
+		t.Errorf("ping answered with %x", conn.written.Bytes())
+	}
+
+	opcode, message, err = ws.ReadMessage()
+	if err != nil || opcode != opBinary || !bytes.Equal(message, []byte{0xff}) {
+		t.Errorf("binary message read as %d %x: %v", opcode, message, err)
+	}
+}